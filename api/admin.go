@@ -0,0 +1,443 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	"ipe/app"
+	"ipe/config"
+	"ipe/storage"
+	"ipe/utils"
+)
+
+// Number of random bytes of the generated keys and secrets (20 hexadecimal characters)
+const generatedKeySize = 10
+
+// Pusher error codes sent to the live connections of a disabled or removed app
+const (
+	applicationDoesNotExistCode = 4001
+	applicationDisabledCode     = 4003
+)
+
+// AdminAuthentication Authenticate the admin API
+//
+// The requests are signed exactly like the REST API requests,
+// but using the admin key and secret instead of the app credentials.
+func AdminAuthentication(key, secret string, timestampWindow time.Duration) func(http.Handler) http.Handler {
+	if timestampWindow <= 0 {
+		timestampWindow = defaultTimestampWindow
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			// Without credentials every request would be accepted
+			if key == "" || secret == "" {
+				log.Error("Not authorized: the admin credentials are not configured")
+				http.Error(w, "admin API not configured", http.StatusUnauthorized)
+				return
+			}
+
+			if !hmac.Equal([]byte(r.URL.Query().Get("auth_key")), []byte(key)) {
+				log.Error("Not authorized: invalid auth_key")
+				http.Error(w, "invalid auth_key", http.StatusUnauthorized)
+				return
+			}
+
+			if err := authenticate(w, r, secret, timestampWindow); err != nil {
+				authenticationError(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// writeJSON writes v as the JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("unexpected error while writing into response %+v", err)
+	}
+}
+
+// GetApps handle list apps
+type GetApps struct{ storage storage.Storage }
+
+// NewGetApps return a new GetApps handler
+func NewGetApps(storage storage.Storage) *GetApps {
+	return &GetApps{storage: storage}
+}
+
+// ServeHTTP List all the applications
+//
+// Example:
+// {
+//   "apps": [
+//     {"name": "Sample", "app_id": "1", "key": "278d525bdf162c739803", "secret": "...", ...}
+//   ]
+// }
+//
+// GET /apps
+func (h *GetApps) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	apps, err := h.storage.ListApps()
+
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]config.Application, 0, len(apps))
+
+	for _, a := range apps {
+		result = append(result, a.Config())
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"apps": result})
+}
+
+// PostApps handle create app
+type PostApps struct{ storage storage.Storage }
+
+// NewPostApps return a new PostApps handler
+func NewPostApps(storage storage.Storage) *PostApps {
+	return &PostApps{storage: storage}
+}
+
+// ServeHTTP Create a new application
+//
+// The body uses the same fields of the configuration file,
+// the key and the secret are generated if they are not given.
+//
+// Example:
+//
+// {"name":"Sample","app_id":"2","enabled":true,"user_events":true}
+//
+// Response is the created application.
+//
+// POST /apps
+func (h *PostApps) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input config.Application
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(input.Name) == "" || strings.TrimSpace(input.AppID) == "" {
+		http.Error(w, "The name and the app_id are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.storage.GetAppByAppID(input.AppID); err == nil {
+		http.Error(w, fmt.Sprintf("There is already an app with app_id: %s", input.AppID), http.StatusConflict)
+		return
+	}
+
+	if input.Key == "" {
+		input.Key = utils.GenerateKey(generatedKeySize)
+	}
+
+	if input.Secret == "" {
+		input.Secret = utils.GenerateKey(generatedKeySize)
+	}
+
+	application := app.NewApplicationFromConfig(input)
+
+	if err := h.storage.AddApp(application); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	log.Infof("application %s (%s) created", application.Name, application.AppID)
+
+	writeJSON(w, http.StatusCreated, application.Config())
+}
+
+// GetApp handle get app
+type GetApp struct{ storage storage.Storage }
+
+// NewGetApp return a new GetApp handler
+func NewGetApp(storage storage.Storage) *GetApp {
+	return &GetApp{storage: storage}
+}
+
+// ServeHTTP Fetch one application
+//
+// GET /apps/{app_id}
+func (h *GetApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["app_id"]
+
+	application, err := h.storage.GetAppByAppID(appID)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, application.Config())
+}
+
+// PutApp handle update app
+type PutApp struct{ storage storage.Storage }
+
+// NewPutApp return a new PutApp handler
+func NewPutApp(storage storage.Storage) *PutApp {
+	return &PutApp{storage: storage}
+}
+
+// ServeHTTP Update an application
+//
+// Only the given fields are updated, the app_id can not be changed.
+// If the application is disabled, its live connections are terminated.
+//
+// Example:
+//
+// {"enabled":false}
+//
+// Response is the updated application.
+//
+// PUT /apps/{app_id}
+func (h *PutApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["app_id"]
+
+	application, err := h.storage.GetAppByAppID(appID)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusNotFound)
+		return
+	}
+
+	current := application.Config()
+	input := current
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	input.AppID = current.AppID
+
+	if strings.TrimSpace(input.Name) == "" || strings.TrimSpace(input.Key) == "" || strings.TrimSpace(input.Secret) == "" {
+		http.Error(w, "The name, the key and the secret can not be empty", http.StatusBadRequest)
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if other, err := h.storage.GetAppByKey(input.Key); err == nil && other != application {
+		http.Error(w, "key already in use", http.StatusConflict)
+		return
+	}
+
+	if err := updateApp(h.storage, application, input); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, application.Config())
+}
+
+// updateApp applies the configuration to the application through the storage
+// and terminates the live connections if the application was disabled
+// The storage validates the configuration before applying it, so the application is not changed on errors.
+func updateApp(storage storage.Storage, application *app.Application, c config.Application) error {
+	wasEnabled := application.Config().Enabled
+
+	if err := storage.UpdateApp(application.AppID, c); err != nil {
+		return err
+	}
+
+	log.Infof("application %s (%s) updated", c.Name, application.AppID)
+
+	if wasEnabled && !c.Enabled {
+		total := application.TerminateAllConnections(applicationDisabledCode, "Application disabled")
+		log.Infof("application %s (%s) disabled, %d connections terminated", c.Name, application.AppID, total)
+	}
+
+	return nil
+}
+
+// PostAppEnabled handle enable and disable app
+type PostAppEnabled struct {
+	storage storage.Storage
+	enabled bool
+}
+
+// NewPostAppEnable return a new PostAppEnabled handler that enables the app
+func NewPostAppEnable(storage storage.Storage) *PostAppEnabled {
+	return &PostAppEnabled{storage: storage, enabled: true}
+}
+
+// NewPostAppDisable return a new PostAppEnabled handler that disables the app
+func NewPostAppDisable(storage storage.Storage) *PostAppEnabled {
+	return &PostAppEnabled{storage: storage, enabled: false}
+}
+
+// ServeHTTP Enable or disable an application
+//
+// When disabled, the live connections receive the error 4003 and are closed.
+//
+// Response is the updated application.
+//
+// POST /apps/{app_id}/enable
+// POST /apps/{app_id}/disable
+func (h *PostAppEnabled) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["app_id"]
+
+	application, err := h.storage.GetAppByAppID(appID)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusNotFound)
+		return
+	}
+
+	c := application.Config()
+	c.Enabled = h.enabled
+
+	if err := updateApp(h.storage, application, c); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, application.Config())
+}
+
+// PostAppRotateSecret handle rotate app secret
+type PostAppRotateSecret struct{ storage storage.Storage }
+
+// NewPostAppRotateSecret return a new PostAppRotateSecret handler
+func NewPostAppRotateSecret(storage storage.Storage) *PostAppRotateSecret {
+	return &PostAppRotateSecret{storage: storage}
+}
+
+// ServeHTTP Generate a new secret for the application
+//
+// The live connections are not affected, but new signatures must use the new secret.
+//
+// Response is the updated application.
+//
+// POST /apps/{app_id}/rotate_secret
+func (h *PostAppRotateSecret) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["app_id"]
+
+	application, err := h.storage.GetAppByAppID(appID)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusNotFound)
+		return
+	}
+
+	c := application.Config()
+	c.Secret = utils.GenerateKey(generatedKeySize)
+
+	if err := updateApp(h.storage, application, c); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, application.Config())
+}
+
+// DeleteApp handle delete app
+type DeleteApp struct{ storage storage.Storage }
+
+// NewDeleteApp return a new DeleteApp handler
+func NewDeleteApp(storage storage.Storage) *DeleteApp {
+	return &DeleteApp{storage: storage}
+}
+
+// ServeHTTP Remove an application
+//
+// The live connections receive the error 4001 and are closed.
+//
+// Response is an empty JSON hash.
+//
+// DELETE /apps/{app_id}
+func (h *DeleteApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["app_id"]
+
+	application, err := h.storage.GetAppByAppID(appID)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusNotFound)
+		return
+	}
+
+	if err := h.storage.RemoveApp(appID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	total := application.TerminateAllConnections(applicationDoesNotExistCode, "Application does not exist")
+	log.Infof("application %s removed, %d connections terminated", application.AppID, total)
+
+	application.StopWebhooks()
+
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// PostReplayWebhooks handle replay the dead letter file
+type PostReplayWebhooks struct {
+	storage  storage.Storage
+	filename string
+}
+
+// NewPostReplayWebhooks return a new PostReplayWebhooks handler for the given dead letter file
+func NewPostReplayWebhooks(storage storage.Storage, filename string) *PostReplayWebhooks {
+	return &PostReplayWebhooks{storage: storage, filename: filename}
+}
+
+// ServeHTTP Queue again the webhooks of the dead letter file
+//
+// The webhooks are delivered in background with the current configuration of the running applications,
+// including the ones created through the admin API. The webhooks that fail again are appended back to the file,
+// the ones whose application does not exist are kept in it.
+//
+// Example:
+//
+// {"queued": 10, "kept": 1}
+//
+// POST /webhooks/replay
+func (h *PostReplayWebhooks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.filename == "" {
+		http.Error(w, "webhooks_dead_letter is not configured", http.StatusNotFound)
+		return
+	}
+
+	queued, kept, err := app.QueueDeadLetters(h.filename, h.storage.GetAppByAppID)
+
+	if err != nil {
+		log.Errorf("replaying the webhooks %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("%d webhooks queued, %d webhooks kept in the dead letter file", queued, kept)
+
+	writeJSON(w, http.StatusAccepted, map[string]int{"queued": queued, "kept": kept})
+}
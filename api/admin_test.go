@@ -0,0 +1,269 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"ipe/app"
+	"ipe/config"
+	"ipe/connection"
+	"ipe/mocks"
+	"ipe/storage"
+	"ipe/utils"
+)
+
+func newAdminTestStorage() (storage.Storage, *app.Application) {
+	a := newTestApp()
+	a.Enabled = true
+
+	_storage := storage.NewInMemory()
+	_ = _storage.AddApp(a)
+
+	return _storage, a
+}
+
+func serveAdmin(handler http.Handler, method, path, body string, vars map[string]string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r = mux.SetURLVars(r, vars)
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func Test_adminAuthentication(t *testing.T) {
+	query := url.Values{}
+	query.Set("auth_key", "admin")
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	query.Set("auth_signature", utils.HashMAC([]byte("GET\n/apps\n"+prepareQueryString(query)), []byte("secret")))
+
+	handler := AdminAuthentication("admin", "secret", 0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := serveAdmin(handler, "GET", "/apps?"+query.Encode(), "", nil)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	// Signed with a valid app key, but not with the admin credentials
+	query.Set("auth_key", testApp.Key)
+
+	w = serveAdmin(handler, "GET", "/apps?"+query.Encode(), "", nil)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_adminAuthentication_without_credentials(t *testing.T) {
+	query := url.Values{}
+	query.Set("auth_key", "")
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	query.Set("auth_signature", utils.HashMAC([]byte("GET\n/apps\n"+prepareQueryString(query)), []byte("")))
+
+	handler := AdminAuthentication("", "", 0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := serveAdmin(handler, "GET", "/apps?"+query.Encode(), "", nil)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_postApps(t *testing.T) {
+	_storage, existing := newAdminTestStorage()
+
+	w := serveAdmin(&PostApps{_storage}, "POST", "/apps", `{"name":"New","app_id":"admin-new","enabled":true}`, nil)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("w.Code == %d, wants %d (%s)", w.Code, http.StatusCreated, w.Body.String())
+	}
+
+	var created config.Application
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+
+	if created.Key == "" || created.Secret == "" {
+		t.Errorf("created == %+v, wants generated key and secret", created)
+	}
+
+	if _, err := _storage.GetAppByKey(created.Key); err != nil {
+		t.Errorf("GetAppByKey(%q) == _, %v, wants nil", created.Key, err)
+	}
+
+	// Duplicated app_id
+	w = serveAdmin(&PostApps{_storage}, "POST", "/apps", `{"name":"New","app_id":"`+existing.AppID+`"}`, nil)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusConflict)
+	}
+}
+
+func Test_putApp(t *testing.T) {
+	_storage, a := newAdminTestStorage()
+
+	w := serveAdmin(&PutApp{_storage}, "PUT", "/apps/"+a.AppID, `{"name":"Renamed","app_id":"ignored"}`, map[string]string{"app_id": a.AppID})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	if c := a.Config(); c.Name != "Renamed" || c.Secret != "123" || c.AppID == "ignored" {
+		t.Errorf("a.Config() == %+v, wants only the name updated", c)
+	}
+}
+
+func Test_putApp_repeated_webhook_url(t *testing.T) {
+	_storage, a := newAdminTestStorage()
+
+	body := `{"webhooks":{"enabled":true,"url":"http://127.0.0.1/hook","targets":[{"url":"http://127.0.0.1/hook"}]}}`
+
+	w := serveAdmin(&PutApp{_storage}, "PUT", "/apps/"+a.AppID, body, map[string]string{"app_id": a.AppID})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusBadRequest)
+	}
+
+	if c := a.Config(); len(c.WebHooks.Targets) != 0 {
+		t.Errorf("c.WebHooks.Targets == %+v, wants none", c.WebHooks.Targets)
+	}
+}
+
+func Test_postAppDisable(t *testing.T) {
+	_storage, a := newAdminTestStorage()
+
+	a.Connect(connection.New("1", mocks.MockSocket{}))
+
+	w := serveAdmin(NewPostAppDisable(_storage), "POST", "/apps/"+a.AppID+"/disable", "", map[string]string{"app_id": a.AppID})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	if a.Enabled {
+		t.Errorf("a.Enabled == %t, wants %t", a.Enabled, false)
+	}
+
+	if _, err := a.FindConnection("1"); err == nil {
+		t.Errorf("a.FindConnection('1') == _, %v, wants !nil", err)
+	}
+}
+
+func Test_postAppRotateSecret(t *testing.T) {
+	_storage, a := newAdminTestStorage()
+
+	w := serveAdmin(&PostAppRotateSecret{_storage}, "POST", "/apps/"+a.AppID+"/rotate_secret", "", map[string]string{"app_id": a.AppID})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	if a.Secret == "123" || a.Secret == "" {
+		t.Errorf("a.Secret == %q, wants a new secret", a.Secret)
+	}
+}
+
+func Test_deleteApp(t *testing.T) {
+	_storage, a := newAdminTestStorage()
+
+	a.Connect(connection.New("1", mocks.MockSocket{}))
+
+	w := serveAdmin(&DeleteApp{_storage}, "DELETE", "/apps/"+a.AppID, "", map[string]string{"app_id": a.AppID})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	if _, err := _storage.GetAppByAppID(a.AppID); err == nil {
+		t.Errorf("GetAppByAppID(%q) == _, %v, wants !nil", a.AppID, err)
+	}
+
+	if _, err := a.FindConnection("1"); err == nil {
+		t.Errorf("a.FindConnection('1') == _, %v, wants !nil", err)
+	}
+
+	w = serveAdmin(&DeleteApp{_storage}, "DELETE", "/apps/"+a.AppID, "", map[string]string{"app_id": a.AppID})
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func Test_postReplayWebhooks(t *testing.T) {
+	received := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	// Created by the admin API, the replay must find it in the live storage
+	_storage, a := newAdminTestStorage()
+	a.WebHooks = true
+	defer a.StopWebhooks()
+
+	payload := `{"time_ms":1,"events":[{"name":"channel_vacated","channel":"hello"}]}`
+	var letters []byte
+
+	for _, appID := range []string{a.AppID, "unknown"} {
+		letter, _ := json.Marshal(app.DeadLetter{AppID: appID, URL: server.URL, Attempts: 4, Error: "failed", Payload: json.RawMessage(payload)})
+		letters = append(append(letters, letter...), '\n')
+	}
+
+	deadLetter := filepath.Join(t.TempDir(), "dead-letter.log")
+
+	if err := ioutil.WriteFile(deadLetter, letters, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveAdmin(NewPostReplayWebhooks(_storage, deadLetter), "POST", "/webhooks/replay", "", nil)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("w.Code == %d, wants %d (%s)", w.Code, http.StatusAccepted, w.Body.String())
+	}
+
+	var result map[string]int
+
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result["queued"] != 1 || result["kept"] != 1 {
+		t.Errorf("result == %v, wants %d queued and %d kept", result, 1, 1)
+	}
+
+	// Delivered in background, after the response
+	select {
+	case body := <-received:
+		if body != payload {
+			t.Errorf("body == %s, wants %s", body, payload)
+		}
+	case <-time.After(time.Second):
+		t.Error("the webhook was not delivered")
+	}
+
+	if data, _ := ioutil.ReadFile(deadLetter); !strings.Contains(string(data), `"app_id":"unknown"`) || strings.Count(string(data), "\n") != 1 {
+		t.Errorf("dead letter file == %s, wants only the unknown app", data)
+	}
+
+	w = serveAdmin(NewPostReplayWebhooks(_storage, ""), "POST", "/webhooks/replay", "", nil)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -5,16 +5,26 @@
 package api
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/gorilla/mux"
 
+	"ipe/channel"
 	"ipe/events"
 	"ipe/storage"
 	"ipe/utils"
@@ -24,6 +34,23 @@ import (
 // See: http://blogs.gnome.org/cneumair/2008/09/30/1-kb-1024-bytes-no-1-kb-1000-bytes/
 const maxDataEventSize = 10 * 1000
 
+// Default tolerance between the auth_timestamp and the server time
+const defaultTimestampWindow = 600 * time.Second
+
+// Maximum number of events permitted in a single batch
+const maxBatchSize = 10
+
+// Maximum size of a request body, read before the signature is checked
+// Enough for a full batch with the data of every event escaped as \uXXXX (6 bytes per character)
+// and room left for the names and the channels
+const maxBodySize = 8 * maxBatchSize * maxDataEventSize
+
+// errBodyTooLarge the request body is larger than maxBodySize
+var errBodyTooLarge = fmt.Errorf("request body too large, the maximum is %d bytes", maxBodySize)
+
+// Size of the nonce used to encrypt the payload of private-encrypted channels (NaCl secretbox)
+const encryptionNonceSize = 24
+
 // Prepare QueryString
 func prepareQueryString(params url.Values) string {
 	var keys []string
@@ -53,7 +80,16 @@ func prepareQueryString(params url.Values) string {
 //  * The request path (e.g. /some/resource)
 //  * The query parameters sorted by key, with keys converted to lowercase, then joined as in the query string.
 //    Note that the string must not be url escaped (e.g. given the keys auth_key: foo, Name: Something else, you get auth_key=foo&name=Something else)
-func Authentication(storage storage.Storage) func(http.Handler) http.Handler {
+//
+// The auth_timestamp must be within timestampWindow of the server time, if timestampWindow is zero
+// the default window of 600 seconds is used.
+//
+// Requests with a body must send the body_md5 parameter, the hex encoded MD5 of the body.
+func Authentication(storage storage.Storage, timestampWindow time.Duration) func(http.Handler) http.Handler {
+	if timestampWindow <= 0 {
+		timestampWindow = defaultTimestampWindow
+	}
+
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			var (
@@ -69,25 +105,94 @@ func Authentication(storage storage.Storage) func(http.Handler) http.Handler {
 				return
 			}
 
-			query := r.URL.Query()
+			_, secret := app.Credentials()
 
-			signature := query.Get("auth_signature")
-			query.Del("auth_signature")
+			if err := authenticate(w, r, secret, timestampWindow); err != nil {
+				authenticationError(w, err)
+				return
+			}
 
-			queryString := prepareQueryString(query)
+			next.ServeHTTP(w, r)
+		}
 
-			toSign := strings.ToUpper(r.Method) + "\n" + r.URL.Path + "\n" + queryString
+		return http.HandlerFunc(fn)
+	}
+}
 
-			if utils.HashMAC([]byte(toSign), []byte(app.Secret)) == signature {
-				next.ServeHTTP(w, r)
-			} else {
-				log.Error("Not authorized")
-				http.Error(w, "Not authorized", http.StatusUnauthorized)
+// authenticationError writes the error of authenticate, 413 if the body is too large, 401 otherwise
+func authenticationError(w http.ResponseWriter, err error) {
+	if err == errBodyTooLarge {
+		log.Errorf("Request rejected: %+v", err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	log.Errorf("Not authorized: %+v", err)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// authenticate validates the auth_timestamp, body_md5 and auth_signature of the request.
+// The request body is read, up to maxBodySize, and replaced, so it can be read again by the next handler.
+func authenticate(w http.ResponseWriter, r *http.Request, secret string, timestampWindow time.Duration) error {
+	query := r.URL.Query()
+
+	timestamp, err := strconv.ParseInt(query.Get("auth_timestamp"), 10, 64)
+
+	if err != nil {
+		return errors.New("missing or invalid auth_timestamp")
+	}
+
+	now := time.Now()
+	given := time.Unix(timestamp, 0)
+
+	if given.Before(now.Add(-timestampWindow)) || given.After(now.Add(timestampWindow)) {
+		return fmt.Errorf(
+			"timestamp expired: given timestamp (%s) not within %.0fs of server time (%s)",
+			given.UTC().Format(time.RFC3339), timestampWindow.Seconds(), now.UTC().Format(time.RFC3339),
+		)
+	}
+
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+
+		if err != nil {
+			// MaxBytesReader returns the body up to the limit before failing
+			if int64(len(body)) >= maxBodySize {
+				return errBodyTooLarge
 			}
+
+			return errors.New("could not read the request body")
 		}
 
-		return http.HandlerFunc(fn)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if len(body) > 0 {
+			bodyMD5 := query.Get("body_md5")
+
+			if bodyMD5 == "" {
+				return errors.New("missing body_md5")
+			}
+
+			sum := md5.Sum(body)
+
+			if !hmac.Equal([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(bodyMD5))) {
+				return errors.New("invalid body_md5: the MD5 of the request body does not match")
+			}
+		}
 	}
+
+	signature := query.Get("auth_signature")
+	query.Del("auth_signature")
+
+	queryString := prepareQueryString(query)
+
+	toSign := strings.ToUpper(r.Method) + "\n" + r.URL.Path + "\n" + queryString
+
+	if !hmac.Equal([]byte(utils.HashMAC([]byte(toSign), []byte(secret))), []byte(signature)) {
+		return fmt.Errorf("invalid signature: you should have sent HmacSHA256Hex(%q, your_secret)", toSign)
+	}
+
+	return nil
 }
 
 // CheckAppDisabled Check if the application is disabled
@@ -106,7 +211,7 @@ func CheckAppDisabled(storage storage.Storage) func(http.Handler) http.Handler {
 				return
 			}
 
-			if !currentApp.Enabled {
+			if !currentApp.IsEnabled() {
 				http.Error(w, "Application disabled", http.StatusForbidden)
 				return
 			}
@@ -135,9 +240,18 @@ func NewPostEvents(storage storage.Storage) *PostEvents {
 //
 // Example:
 //
-// {"name":"foo","channels":["project-3"],"data":"{\"some\":\"data\"}"}
+// {"name":"foo","channels":["project-3"],"data":"{\"some\":\"data\"}","info":"subscription_count"}
 //
-// Response is an empty JSON hash.
+// Response is an empty JSON hash, unless attributes were requested through the info parameter.
+// 'user_count' is only allowed if all the channels are presence channels.
+//
+// {
+//   "channels": {
+//     "project-3": {
+//       "subscription_count": 1
+//     }
+//   }
+// }
 //
 // POST /apps/{app_id}/events
 func (h *PostEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -150,6 +264,7 @@ func (h *PostEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusBadRequest)
+		return
 	}
 
 	var input struct {
@@ -158,6 +273,7 @@ func (h *PostEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Channels []string        `json:"channels,omitempty"`
 		Channel  string          `json:"channel,omitempty"`
 		SocketID string          `json:"socket_id,omitempty"`
+		Info     string          `json:"info,omitempty"`
 	}
 
 	err = json.NewDecoder(r.Body).Decode(&input)
@@ -178,22 +294,249 @@ func (h *PostEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		input.Channels = append(input.Channels, input.Channel)
 	}
 
+	// The payload of each encrypted channel is encrypted with its own key
+	for _, c := range input.Channels {
+		if !utils.IsPrivateEncryptedChannel(c) {
+			continue
+		}
+
+		if len(input.Channels) > 1 {
+			http.Error(w, "Cannot trigger an event on multiple channels if one of them is private-encrypted", http.StatusBadRequest)
+			return
+		}
+
+		if err := validateEncryptedData(input.Data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// If an attribute such as user_count is requested, and the event is not sent
+	// only to presence channels, the API will return an error (400 code)
+	if requestedUserCount, _ := parseInfo(input.Info); requestedUserCount {
+		for _, c := range input.Channels {
+			if !utils.IsPresenceChannel(c) {
+				http.Error(w, "Attribute user_count is restricted to presence channels", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	channels := make(map[string]channelInfo, len(input.Channels))
+
 	for _, c := range input.Channels {
 		channel := app.FindOrCreateChannelByChannelID(c)
 
 		if err := app.Publish(channel, events.Raw{Event: input.Name, Channel: c, Data: input.Data}, input.SocketID); err != nil {
 			log.Errorf("error publishing event %+v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
 		}
+
+		channels[c] = newChannelInfo(channel, input.Info)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte("{}")); err != nil {
+
+	js := make(map[string]interface{}, 1)
+
+	if strings.TrimSpace(input.Info) != "" {
+		js["channels"] = channels
+	}
+
+	if err := json.NewEncoder(w).Encode(js); err != nil {
 		log.Errorf("unexpected error while writing into response %+v", err)
 	}
 }
 
+// PostBatchEvents handle post batch events
+type PostBatchEvents struct{ storage storage.Storage }
+
+// NewPostBatchEvents return a new PostBatchEvents handler
+func NewPostBatchEvents(storage storage.Storage) *PostBatchEvents {
+	return &PostBatchEvents{storage: storage}
+}
+
+// ServeHTTP Triggers multiple events in a single call (up to 10 per request).
+//
+// Each event in the batch has its own name, channel, data and optionally socket_id and info.
+// The size limit is applied to each event individually.
+//
+// Example:
+//
+// {"batch":[{"name":"foo","channel":"project-3","data":"{\"some\":\"data\"}","info":"subscription_count"}]}
+//
+// Response contains one entry for each event, in the same order,
+// with the attributes requested through the info parameter.
+//
+// {"batch":[{"subscription_count":1}]}
+//
+// POST /apps/{app_id}/batch_events
+func (h *PostBatchEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		pathVars = mux.Vars(r)
+		appID    = pathVars["app_id"]
+	)
+
+	app, err := h.storage.GetAppByAppID(appID)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Batch []struct {
+			Name     string          `json:"name"`
+			Channel  string          `json:"channel"`
+			Data     json.RawMessage `json:"data"`
+			SocketID string          `json:"socket_id,omitempty"`
+			Info     string          `json:"info,omitempty"`
+		} `json:"batch"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if len(input.Batch) == 0 {
+		http.Error(w, "Batch must contain at least one event", http.StatusBadRequest)
+		return
+	}
+
+	if len(input.Batch) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch too large, the maximum is %d events", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	// Validate the whole batch before publishing anything
+	for i, e := range input.Batch {
+		if strings.TrimSpace(e.Name) == "" || strings.TrimSpace(e.Channel) == "" {
+			http.Error(w, fmt.Sprintf("Event %d must have a name and a channel", i), http.StatusBadRequest)
+			return
+		}
+
+		// The event data should not be larger than 10KB.
+		if len(e.Data) > maxDataEventSize {
+			http.Error(w, fmt.Sprintf("Event %d is too large.", i), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if utils.IsPrivateEncryptedChannel(e.Channel) {
+			if err := validateEncryptedData(e.Data); err != nil {
+				http.Error(w, fmt.Sprintf("Event %d: %s", i, err.Error()), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// If an attribute such as user_count is requested, and the event is not sent
+		// to a presence channel, the API will return an error (400 code)
+		if requestedUserCount, _ := parseInfo(e.Info); requestedUserCount && !utils.IsPresenceChannel(e.Channel) {
+			http.Error(w, "Attribute user_count is restricted to presence channels", http.StatusBadRequest)
+			return
+		}
+	}
+
+	batch := make([]channelInfo, 0, len(input.Batch))
+
+	for _, e := range input.Batch {
+		channel := app.FindOrCreateChannelByChannelID(e.Channel)
+
+		if err := app.Publish(channel, events.Raw{Event: e.Name, Channel: e.Channel, Data: e.Data}, e.SocketID); err != nil {
+			log.Errorf("error publishing event %+v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		batch = append(batch, newChannelInfo(channel, e.Info))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	js := make(map[string]interface{}, 1)
+	js["batch"] = batch
+
+	if err := json.NewEncoder(w).Encode(js); err != nil {
+		log.Error(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// validateEncryptedData verifies that the data sent to a private-encrypted channel was encrypted.
+// The data is a JSON encoded string with the nonce and the ciphertext, both base64 encoded.
+//
+// "{\"nonce\":\"...\",\"ciphertext\":\"...\"}"
+func validateEncryptedData(data json.RawMessage) error {
+	var payload string
+
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return errors.New("data sent to private-encrypted channels must be a JSON encoded string")
+	}
+
+	var encrypted struct {
+		Nonce      string `json:"nonce"`
+		Ciphertext string `json:"ciphertext"`
+	}
+
+	if err := json.Unmarshal([]byte(payload), &encrypted); err != nil {
+		return errors.New("data sent to private-encrypted channels must be encrypted, plaintext payloads are refused")
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(encrypted.Nonce)
+
+	if err != nil || len(nonce) != encryptionNonceSize {
+		return fmt.Errorf("data sent to private-encrypted channels must have a base64 encoded %d bytes nonce", encryptionNonceSize)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted.Ciphertext)
+
+	if err != nil || len(ciphertext) == 0 {
+		return errors.New("data sent to private-encrypted channels must have a base64 encoded ciphertext")
+	}
+
+	return nil
+}
+
+// parseInfo returns which attributes were requested in the info parameter
+func parseInfo(info string) (userCount, subscriptionCount bool) {
+	for _, a := range strings.Split(info, ",") {
+		switch strings.TrimSpace(a) {
+		case "user_count":
+			userCount = true
+		case "subscription_count":
+			subscriptionCount = true
+		}
+	}
+
+	return userCount, subscriptionCount
+}
+
+// channelInfo attributes of a channel requested through the info parameter
+type channelInfo struct {
+	UserCount         *int `json:"user_count,omitempty"`
+	SubscriptionCount *int `json:"subscription_count,omitempty"`
+}
+
+// newChannelInfo returns the attributes requested in info for the given channel
+func newChannelInfo(c *channel.Channel, info string) channelInfo {
+	requestedUserCount, requestedSubscriptionCount := parseInfo(info)
+
+	var result channelInfo
+
+	if requestedUserCount {
+		total := c.TotalUsers()
+		result.UserCount = &total
+	}
+
+	if requestedSubscriptionCount {
+		total := c.TotalSubscriptions()
+		result.SubscriptionCount = &total
+	}
+
+	return result
+}
+
 // GetChannels handle get channels
 type GetChannels struct{ storage storage.Storage }
 
@@ -206,7 +549,10 @@ func NewGetChannels(storage storage.Storage) *GetChannels {
 // and optionally one or more attributes for each channel.
 //
 // Notes:
-// 'user_count' is the only attribute documented on the Pusher API
+// Any prefix is accepted, eg: private-orders-
+// For compatibility, the prefix public- returns all the public channels.
+// 'user_count' is only allowed if the prefix starts with presence-
+// 'subscription_count' is allowed for all the channel types
 //
 // Example:
 // {
@@ -223,25 +569,18 @@ func NewGetChannels(storage storage.Storage) *GetChannels {
 // GET /apps/{app_id}/channels
 func (h *GetChannels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var (
-		pathVars   = mux.Vars(r)
-		queryVars  = r.URL.Query()
-		appID      = pathVars["app_id"]
-		filter     = queryVars.Get("filter_by_prefix")
-		info       = queryVars.Get("info")
-		attributes = strings.Split(info, ",")
+		pathVars  = mux.Vars(r)
+		queryVars = r.URL.Query()
+		appID     = pathVars["app_id"]
+		filter    = queryVars.Get("filter_by_prefix")
+		info      = queryVars.Get("info")
 	)
 
-	requestedUserCount := false
-
-	for _, a := range attributes {
-		if a == "user_count" {
-			requestedUserCount = true
-		}
-	}
+	requestedUserCount, _ := parseInfo(info)
 
 	// If an attribute such as user_count is requested, and the request is not limited
 	// to presence channels, the API will return an error (400 code)
-	if requestedUserCount && filter != "presence-" {
+	if requestedUserCount && !utils.IsPresenceChannel(filter) {
 		http.Error(w, "Attribute user_count is restricted to presence channels", http.StatusBadRequest)
 		return
 	}
@@ -250,35 +589,30 @@ func (h *GetChannels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusBadRequest)
+		return
 	}
 
-	channels := make(map[string]interface{})
+	var candidates []*channel.Channel
 
-	switch filter {
-	case "presence-":
-		for _, c := range app.PresenceChannels() {
-			if requestedUserCount {
-				channels[c.ID] = struct {
-					UserCount int `json:"user_count"`
-				}{
-					c.TotalUsers(),
-				}
-			} else {
-				channels[c.ID] = struct{}{}
-			}
-		}
-	case "public-":
-		for _, c := range app.PublicChannels() {
-			channels[c.ID] = struct{}{}
-		}
-	case "private-":
-		for _, c := range app.PrivateChannels() {
-			channels[c.ID] = struct{}{}
-		}
+	switch {
+	case filter == "public-":
+		candidates = app.PublicChannels()
+	case utils.IsPresenceChannel(filter):
+		candidates = app.PresenceChannels()
+	case utils.IsPrivateChannel(filter):
+		candidates = app.PrivateChannels()
 	default:
-		for _, c := range app.Channels() {
-			channels[c.ID] = struct{}{}
+		candidates = app.Channels()
+	}
+
+	channels := make(map[string]channelInfo)
+
+	for _, c := range candidates {
+		if filter != "public-" && !strings.HasPrefix(c.ID, filter) {
+			continue
 		}
+
+		channels[c.ID] = newChannelInfo(c, info)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -436,9 +770,19 @@ func (h *GetChannelUsers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	result := make(map[string][]interface{})
 
-	var users []interface{}
+	var (
+		users []interface{}
+		seen  = make(map[string]bool)
+	)
 
+	// A user can be subscribed with many sockets, it is listed once
 	for _, s := range channel.Subscriptions() {
+		if seen[s.ID] {
+			continue
+		}
+
+		seen[s.ID] = true
+
 		users = append(users, struct {
 			ID string `json:"id"`
 		}{s.ID})
@@ -452,3 +796,119 @@ func (h *GetChannelUsers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Error(err)
 	}
 }
+
+// PostTerminateUserConnections handle terminate user connections
+type PostTerminateUserConnections struct{ storage storage.Storage }
+
+// NewPostTerminateUserConnections return a new PostTerminateUserConnections handler
+func NewPostTerminateUserConnections(storage storage.Storage) *PostTerminateUserConnections {
+	return &PostTerminateUserConnections{storage: storage}
+}
+
+// ServeHTTP Terminates all the connections of the given user,
+// signed in as the user or subscribed to a presence channel as the user.
+//
+// Each connection receives a pusher:error with the code 4009 and is closed,
+// member_removed and channel_vacated webhooks are sent as usual.
+//
+// Response is an empty JSON hash.
+//
+// POST /apps/{app_id}/users/{user_id}/terminate_connections
+func (h *PostTerminateUserConnections) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		pathVars = mux.Vars(r)
+		appID    = pathVars["app_id"]
+		userID   = pathVars["user_id"]
+	)
+
+	app, err := h.storage.GetAppByAppID(appID)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusBadRequest)
+		return
+	}
+
+	// User ID could not be empty
+	if strings.TrimSpace(userID) == "" {
+		http.Error(w, "Empty user id", http.StatusBadRequest)
+		return
+	}
+
+	total := app.TerminateUserConnections(userID)
+	log.Infof("terminated %d connections of the user %s", total, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write([]byte("{}")); err != nil {
+		log.Errorf("unexpected error while writing into response %+v", err)
+	}
+}
+
+// PostUserEvents handle send events to users
+type PostUserEvents struct{ storage storage.Storage }
+
+// NewPostUserEvents return a new PostUserEvents handler
+func NewPostUserEvents(storage storage.Storage) *PostUserEvents {
+	return &PostUserEvents{storage: storage}
+}
+
+// ServeHTTP Sends an event to every connection signed in as the given user.
+// The event is delivered on the #server-to-user-{user_id} channel.
+//
+// Example:
+//
+// {"name":"foo","data":"{\"some\":\"data\"}"}
+//
+// Response is an empty JSON hash.
+//
+// POST /apps/{app_id}/users/{user_id}/events
+func (h *PostUserEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		pathVars = mux.Vars(r)
+		appID    = pathVars["app_id"]
+		userID   = pathVars["user_id"]
+	)
+
+	app, err := h.storage.GetAppByAppID(appID)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not found an app with app_id: %s", appID), http.StatusBadRequest)
+		return
+	}
+
+	// User ID could not be empty
+	if strings.TrimSpace(userID) == "" {
+		http.Error(w, "Empty user id", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Name string          `json:"name"`
+		Data json.RawMessage `json:"data"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || strings.TrimSpace(input.Name) == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// The event data should not be larger than 10KB.
+	if len(input.Data) > maxDataEventSize {
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	total, err := app.SendToUser(userID, input.Name, input.Data)
+
+	if err != nil {
+		log.Errorf("error sending event to user %+v", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("event %s sent to %d connections of the user %s", input.Name, total, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write([]byte("{}")); err != nil {
+		log.Errorf("unexpected error while writing into response %+v", err)
+	}
+}
@@ -1,12 +1,19 @@
 package api
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -15,6 +22,7 @@ import (
 	"ipe/connection"
 	"ipe/mocks"
 	"ipe/storage"
+	"ipe/utils"
 )
 
 var (
@@ -142,6 +150,54 @@ func Test_getChannels_filter_by_presence_prefix_and_user_count(t *testing.T) {
 	}
 }
 
+func Test_getChannelUsers_one_user_with_many_sockets(t *testing.T) {
+	a := newTestApp()
+	_storage := storage.NewInMemory()
+	_ = _storage.AddApp(a)
+
+	channel := a.FindOrCreateChannelByChannelID("presence-zz")
+
+	for i, data := range []string{`{"user_id":"u1"}`, `{"user_id":"u1"}`, `{"user_id":"u2"}`} {
+		if err := a.Subscribe(channel, connection.New(strconv.Itoa(i), mocks.MockSocket{}), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/apps/%s/channels/presence-zz/users", a.AppID), nil)
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id":       a.AppID,
+		"channel_name": "presence-zz",
+	})
+	w := httptest.NewRecorder()
+
+	handler := &GetChannelUsers{_storage}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var data struct {
+		Users []struct {
+			ID string `json:"id"`
+		} `json:"users"`
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]int)
+
+	for _, user := range data.Users {
+		ids[user.ID]++
+	}
+
+	if len(data.Users) != 2 || ids["u1"] != 1 || ids["u2"] != 1 {
+		t.Errorf("users == %+v, wants u1 and u2 once", data.Users)
+	}
+}
+
 // User count only allowed in Presence channels
 func Test_getChannels_filter_by_private_prefix_and_info_user_count(t *testing.T) {
 	appID := testApp.AppID
@@ -225,3 +281,422 @@ func Test_getChannels_filter_by_private_prefix(t *testing.T) {
 		t.Errorf("!exists == %t, want %t", !exists, false)
 	}
 }
+
+func Test_postBatchEvents(t *testing.T) {
+	appID := testApp.AppID
+
+	body := `{"batch":[` +
+		`{"name":"e1","channel":"presence-c1","data":"{}","info":"user_count,subscription_count"},` +
+		`{"name":"e2","channel":"c2","data":"{}"}` +
+		`]}`
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/batch_events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostBatchEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusOK)
+	}
+
+	data := make(map[string][]map[string]interface{})
+	_ = json.Unmarshal(w.Body.Bytes(), &data)
+
+	batch := data["batch"]
+
+	if len(batch) != 2 {
+		t.Fatalf("len(%v) == %d, want %d", batch, len(batch), 2)
+	}
+
+	if batch[0]["user_count"] != float64(1) {
+		t.Errorf("batch[0]['user_count'] == %v, want %d", batch[0]["user_count"], 1)
+	}
+
+	if batch[0]["subscription_count"] != float64(2) {
+		t.Errorf("batch[0]['subscription_count'] == %v, want %d", batch[0]["subscription_count"], 2)
+	}
+
+	if len(batch[1]) != 0 {
+		t.Errorf("len(%v) == %d, want %d", batch[1], len(batch[1]), 0)
+	}
+}
+
+func Test_postBatchEvents_event_too_large(t *testing.T) {
+	appID := testApp.AppID
+
+	data := strings.Repeat("a", maxDataEventSize)
+	body := fmt.Sprintf(`{"batch":[{"name":"e1","channel":"c2","data":"{}"},{"name":"e2","channel":"c2","data":"%s"}]}`, data)
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/batch_events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostBatchEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// User count only allowed in Presence channels
+func Test_postBatchEvents_user_count_on_public_channel(t *testing.T) {
+	appID := testApp.AppID
+
+	body := `{"batch":[{"name":"e1","channel":"c2","data":"{}","info":"user_count"}]}`
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/batch_events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostBatchEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// signedRequest returns a request signed with the testApp credentials
+func signedRequest(method, path string, query url.Values, body string) *http.Request {
+	query.Set("auth_key", testApp.Key)
+	query.Set("auth_version", "1.0")
+
+	if body != "" {
+		sum := md5.Sum([]byte(body))
+		query.Set("body_md5", hex.EncodeToString(sum[:]))
+	}
+
+	toSign := method + "\n" + path + "\n" + prepareQueryString(query)
+	query.Set("auth_signature", utils.HashMAC([]byte(toSign), []byte(testApp.Secret)))
+
+	r, _ := http.NewRequest(method, path+"?"+query.Encode(), strings.NewReader(body))
+
+	return mux.SetURLVars(r, map[string]string{
+		"app_id": testApp.AppID,
+	})
+}
+
+func serveAuthenticated(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	handler := Authentication(database, 0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func Test_authentication(t *testing.T) {
+	query := url.Values{}
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+
+	w := serveAuthenticated(signedRequest("POST", "/apps/"+testApp.AppID+"/events", query, `{"name":"foo"}`))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+}
+
+func Test_authentication_invalid_signature(t *testing.T) {
+	query := url.Values{}
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+
+	r := signedRequest("GET", "/apps/"+testApp.AppID+"/channels", query, "")
+
+	query = r.URL.Query()
+	query.Set("auth_signature", "invalid")
+	r.URL.RawQuery = query.Encode()
+
+	w := serveAuthenticated(r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if !strings.HasPrefix(w.Body.String(), "invalid signature") {
+		t.Errorf("w.Body == %q, wants prefix %q", w.Body.String(), "invalid signature")
+	}
+}
+
+func Test_authentication_body_md5_mismatch(t *testing.T) {
+	query := url.Values{}
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+
+	r := signedRequest("POST", "/apps/"+testApp.AppID+"/events", query, `{"name":"foo"}`)
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"name":"bar"}`))
+
+	w := serveAuthenticated(r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if !strings.HasPrefix(w.Body.String(), "invalid body_md5") {
+		t.Errorf("w.Body == %q, wants prefix %q", w.Body.String(), "invalid body_md5")
+	}
+}
+
+func Test_authentication_expired_timestamp(t *testing.T) {
+	query := url.Values{}
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+
+	w := serveAuthenticated(signedRequest("GET", "/apps/"+testApp.AppID+"/channels", query, ""))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if !strings.HasPrefix(w.Body.String(), "timestamp expired") {
+		t.Errorf("w.Body == %q, wants prefix %q", w.Body.String(), "timestamp expired")
+	}
+}
+
+func Test_authentication_body_too_large(t *testing.T) {
+	query := url.Values{}
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+
+	w := serveAuthenticated(signedRequest("POST", "/apps/"+testApp.AppID+"/events", query, strings.Repeat("a", maxBodySize+1)))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	query = url.Values{}
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+
+	w = serveAuthenticated(signedRequest("POST", "/apps/"+testApp.AppID+"/events", query, strings.Repeat("a", maxBodySize)))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+}
+
+func Test_postEvents(t *testing.T) {
+	appID := testApp.AppID
+
+	body := `{"name":"foo","channels":["c2"],"data":"{}"}`
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusOK)
+	}
+
+	if strings.TrimSpace(w.Body.String()) != "{}" {
+		t.Errorf("w.Body == %q, wants %q", w.Body.String(), "{}")
+	}
+}
+
+func Test_postEvents_without_data(t *testing.T) {
+	appID := testApp.AppID
+
+	body := `{"name":"foo","channels":["c2"]}`
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusOK)
+	}
+}
+
+func Test_postEvents_info(t *testing.T) {
+	appID := testApp.AppID
+
+	body := `{"name":"foo","channels":["presence-c1"],"data":"{}","info":"user_count,subscription_count"}`
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusOK)
+	}
+
+	data := make(map[string]map[string]map[string]interface{})
+	_ = json.Unmarshal(w.Body.Bytes(), &data)
+
+	c, exists := data["channels"]["presence-c1"]
+
+	if !exists {
+		t.Fatalf("!exists == %t, want %t", !exists, false)
+	}
+
+	if c["user_count"] != float64(1) {
+		t.Errorf("c['user_count'] == %v, want %d", c["user_count"], 1)
+	}
+
+	if c["subscription_count"] != float64(2) {
+		t.Errorf("c['subscription_count'] == %v, want %d", c["subscription_count"], 2)
+	}
+}
+
+// User count only allowed in Presence channels
+func Test_postEvents_info_user_count_on_public_channel(t *testing.T) {
+	appID := testApp.AppID
+
+	body := `{"name":"foo","channels":["presence-c1","c2"],"data":"{}","info":"user_count"}`
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_getChannels_filter_by_arbitrary_prefix_and_subscription_count(t *testing.T) {
+	_app := newTestApp()
+
+	orders := channel2.New("private-orders-1")
+	_app.AddChannel(orders)
+	_app.AddChannel(channel2.New("private-orders-2"))
+	_app.AddChannel(channel2.New("private-users-1"))
+	_app.AddChannel(channel2.New("orders"))
+
+	_ = _app.Subscribe(orders, connection.New("123.456", mocks.MockSocket{}), "")
+
+	_storage := storage.NewInMemory()
+	_ = _storage.AddApp(_app)
+
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/apps/%s/channels?filter_by_prefix=private-orders-&info=subscription_count", _app.AppID), nil)
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": _app.AppID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &GetChannels{_storage}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusOK)
+	}
+
+	data := make(map[string]map[string]map[string]interface{})
+	_ = json.Unmarshal(w.Body.Bytes(), &data)
+
+	channels := data["channels"]
+
+	if len(channels) != 2 {
+		t.Errorf("len(%v) == %d, want %d", channels, len(channels), 2)
+	}
+
+	if channels["private-orders-1"]["subscription_count"] != float64(1) {
+		t.Errorf("channels['private-orders-1']['subscription_count'] == %v, want %d", channels["private-orders-1"]["subscription_count"], 1)
+	}
+
+	if channels["private-orders-2"]["subscription_count"] != float64(0) {
+		t.Errorf("channels['private-orders-2']['subscription_count'] == %v, want %d", channels["private-orders-2"]["subscription_count"], 0)
+	}
+}
+
+func Test_getChannels_filter_by_presence_sub_prefix_and_user_count(t *testing.T) {
+	appID := testApp.AppID
+
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/apps/%s/channels?filter_by_prefix=presence-c&info=user_count", appID), nil)
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &GetChannels{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusOK)
+	}
+}
+
+func Test_postEvents_private_encrypted_plaintext(t *testing.T) {
+	appID := testApp.AppID
+
+	body := `{"name":"foo","channels":["private-encrypted-c4"],"data":"{\"some\":\"data\"}"}`
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_postEvents_private_encrypted(t *testing.T) {
+	appID := testApp.AppID
+
+	payload, _ := json.Marshal(map[string]string{
+		"nonce":      base64.StdEncoding.EncodeToString(make([]byte, encryptionNonceSize)),
+		"ciphertext": base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+	})
+	data, _ := json.Marshal(string(payload))
+
+	body := `{"name":"foo","channels":["private-encrypted-c4"],"data":` + string(data) + `}`
+
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/apps/%s/events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w := httptest.NewRecorder()
+
+	handler := &PostEvents{database}
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code == %d, wants %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	// Encrypted channels can not be mixed with other channels
+	body = `{"name":"foo","channels":["private-encrypted-c4","c2"],"data":` + string(data) + `}`
+
+	r, _ = http.NewRequest("POST", fmt.Sprintf("/apps/%s/events", appID), strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{
+		"app_id": appID,
+	})
+	w = httptest.NewRecorder()
+
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code == %d, wants %d", w.Code, http.StatusBadRequest)
+	}
+}
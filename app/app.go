@@ -5,17 +5,41 @@
 package app
 
 import (
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"sync"
+	"time"
 
 	log "github.com/golang/glog"
+	"github.com/gorilla/websocket"
 
 	"ipe/channel"
+	"ipe/config"
 	"ipe/connection"
 	"ipe/events"
 	"ipe/subscription"
+	"ipe/utils"
+)
+
+// DefaultActivityTimeout seconds of inactivity before the server pings a connection
+const DefaultActivityTimeout = 120
+
+// DefaultClientEventsPerSecond maximum number of client events per second of each connection
+const DefaultClientEventsPerSecond = 10
+
+// DefaultWebhookMaxRetries attempts after the first failed delivery of a webhook
+const DefaultWebhookMaxRetries = 3
+
+// DefaultWebhookBatchSize maximum number of events sent in a single webhook request
+const DefaultWebhookBatchSize = 50
+
+// Default limits of the presence channels, the same of Pusher
+const (
+	DefaultPresenceMaxMembers      = 100
+	DefaultPresenceMaxUserInfoSize = 1000
+	DefaultPresenceMaxUserIDLength = 128
 )
 
 // Application represents a Pusher application
@@ -32,8 +56,29 @@ type Application struct {
 	WebHooks   bool
 	URLWebHook string
 
-	channels    map[string]*channel.Channel
-	connections map[string]*connection.Connection
+	WebhookMaxRetries    int
+	WebhookBatchSize     int
+	WebhookBatchWindowMs int
+	WebhookTargets       []config.WebhookTarget
+
+	EncryptionMasterKey string
+	ActivityTimeout     int
+	AllowedOrigins      []string
+	VacateGracePeriodMs int
+
+	ClientEventsPerSecond int
+
+	PresenceMaxMembers      int
+	PresenceMaxUserInfoSize int
+	PresenceMaxUserIDLength int
+
+	channels    *channelRegistry
+	connections *connectionRegistry
+
+	webhooks *webhookDispatcher
+
+	// How long the cache channels remember the last event, the channel default if zero
+	cacheTTL time.Duration
 
 	Stats *expvar.Map `json:"-"`
 }
@@ -61,75 +106,303 @@ func NewApplication(
 		UserEvents: userEvents,
 		WebHooks:   webHooks,
 		URLWebHook: webHookURL,
+
+		WebhookMaxRetries:       DefaultWebhookMaxRetries,
+		WebhookBatchSize:        DefaultWebhookBatchSize,
+		ActivityTimeout:         DefaultActivityTimeout,
+		ClientEventsPerSecond:   DefaultClientEventsPerSecond,
+		PresenceMaxMembers:      DefaultPresenceMaxMembers,
+		PresenceMaxUserInfoSize: DefaultPresenceMaxUserInfoSize,
+		PresenceMaxUserIDLength: DefaultPresenceMaxUserIDLength,
 	}
 
-	a.connections = make(map[string]*connection.Connection)
-	a.channels = make(map[string]*channel.Channel)
-	a.Stats = expvar.NewMap(fmt.Sprintf("%s (%s)", a.Name, a.AppID))
+	a.connections = newConnectionRegistry()
+	a.channels = newChannelRegistry()
+	a.webhooks = newWebhookDispatcher(a)
+	a.Stats = newStats(fmt.Sprintf("%s (%s)", a.Name, a.AppID))
+	a.Stats.Set("WriteQueueDepth", expvar.Func(a.writeQueueDepth))
+	a.Stats.Set("WebhookQueueDepth", expvar.Func(a.webhookQueueDepth))
 
 	return a
 }
 
-// Channels returns the full list of channels
-func (a *Application) Channels() []*channel.Channel {
+// NewApplicationFromConfig returns a new Application using the given configuration
+func NewApplicationFromConfig(c config.Application) *Application {
+	a := NewApplication(
+		c.Name,
+		c.AppID,
+		c.Key,
+		c.Secret,
+		c.OnlySSL,
+		c.Enabled,
+		c.UserEvents,
+		c.WebHooks.Enabled,
+		c.WebHooks.URL,
+	)
+
+	a.EncryptionMasterKey = c.EncryptionMasterKey
+	a.AllowedOrigins = copyStrings(c.AllowedOrigins)
+	a.WebhookBatchWindowMs = c.WebHooks.BatchWindowMs
+	a.WebhookTargets = copyTargets(c.WebHooks.Targets)
+	a.VacateGracePeriodMs = c.VacateGracePeriodMs
+
+	if c.ActivityTimeout > 0 {
+		a.ActivityTimeout = c.ActivityTimeout
+	}
+
+	if c.WebHooks.MaxRetries != nil {
+		a.WebhookMaxRetries = *c.WebHooks.MaxRetries
+	}
+
+	if c.WebHooks.BatchSize > 0 {
+		a.WebhookBatchSize = c.WebHooks.BatchSize
+	}
+
+	if c.ClientEventsPerSecond > 0 {
+		a.ClientEventsPerSecond = c.ClientEventsPerSecond
+	}
+
+	if c.PresenceMaxMembers > 0 {
+		a.PresenceMaxMembers = c.PresenceMaxMembers
+	}
+
+	if c.PresenceMaxUserInfoSize > 0 {
+		a.PresenceMaxUserInfoSize = c.PresenceMaxUserInfoSize
+	}
+
+	if c.PresenceMaxUserIDLength > 0 {
+		a.PresenceMaxUserIDLength = c.PresenceMaxUserIDLength
+	}
+
+	return a
+}
+
+// statsMutex protects the creation of the expvar maps
+var statsMutex sync.Mutex
+
+// newStats returns the expvar map with the given name
+// expvar does not allow to unpublish a var, so the map is reused if an app is created again with the same name
+func newStats(name string) *expvar.Map {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	if stats, ok := expvar.Get(name).(*expvar.Map); ok {
+		return stats.Init()
+	}
+
+	return expvar.NewMap(name)
+}
+
+// Config returns the current configuration of the Application
+func (a *Application) Config() config.Application {
 	a.RLock()
 	defer a.RUnlock()
 
-	var channels []*channel.Channel
+	maxRetries := a.WebhookMaxRetries
+
+	return config.Application{
+		Name:       a.Name,
+		AppID:      a.AppID,
+		Key:        a.Key,
+		Secret:     a.Secret,
+		OnlySSL:    a.OnlySSL,
+		Enabled:    a.Enabled,
+		UserEvents: a.UserEvents,
+		WebHooks: config.Webhooks{
+			Enabled:       a.WebHooks,
+			URL:           a.URLWebHook,
+			MaxRetries:    &maxRetries,
+			BatchSize:     a.WebhookBatchSize,
+			BatchWindowMs: a.WebhookBatchWindowMs,
+			Targets:       copyTargets(a.WebhookTargets),
+		},
+		EncryptionMasterKey: a.EncryptionMasterKey,
+		ActivityTimeout:     a.ActivityTimeout,
+		AllowedOrigins:      copyStrings(a.AllowedOrigins),
+		VacateGracePeriodMs: a.VacateGracePeriodMs,
+
+		ClientEventsPerSecond: a.ClientEventsPerSecond,
+
+		PresenceMaxMembers:      a.PresenceMaxMembers,
+		PresenceMaxUserInfoSize: a.PresenceMaxUserInfoSize,
+		PresenceMaxUserIDLength: a.PresenceMaxUserIDLength,
+	}
+}
+
+// Configure updates the Application with the given configuration
+// The AppID can not be changed
+func (a *Application) Configure(c config.Application) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.Name = c.Name
+	a.Key = c.Key
+	a.Secret = c.Secret
+	a.OnlySSL = c.OnlySSL
+	a.Enabled = c.Enabled
+	a.UserEvents = c.UserEvents
+	a.WebHooks = c.WebHooks.Enabled
+	a.URLWebHook = c.WebHooks.URL
+	a.WebhookBatchWindowMs = c.WebHooks.BatchWindowMs
+	a.WebhookTargets = copyTargets(c.WebHooks.Targets)
+	a.VacateGracePeriodMs = c.VacateGracePeriodMs
+	a.EncryptionMasterKey = c.EncryptionMasterKey
+	a.AllowedOrigins = copyStrings(c.AllowedOrigins)
+
+	if c.ActivityTimeout > 0 {
+		a.ActivityTimeout = c.ActivityTimeout
+	}
+
+	if c.WebHooks.MaxRetries != nil {
+		a.WebhookMaxRetries = *c.WebHooks.MaxRetries
+	}
+
+	if c.WebHooks.BatchSize > 0 {
+		a.WebhookBatchSize = c.WebHooks.BatchSize
+	}
+
+	if c.ClientEventsPerSecond > 0 {
+		a.ClientEventsPerSecond = c.ClientEventsPerSecond
+	}
+
+	if c.PresenceMaxMembers > 0 {
+		a.PresenceMaxMembers = c.PresenceMaxMembers
+	}
+
+	if c.PresenceMaxUserInfoSize > 0 {
+		a.PresenceMaxUserInfoSize = c.PresenceMaxUserInfoSize
+	}
 
-	for _, c := range a.channels {
-		channels = append(channels, c)
+	if c.PresenceMaxUserIDLength > 0 {
+		a.PresenceMaxUserIDLength = c.PresenceMaxUserIDLength
 	}
+}
 
-	return channels
+// Credentials returns the current key and secret of the Application
+func (a *Application) Credentials() (key, secret string) {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.Key, a.Secret
 }
 
-// PresenceChannels Only Presence channels
-func (a *Application) PresenceChannels() []*channel.Channel {
+// IsEnabled returns true if the Application accepts connections and requests
+func (a *Application) IsEnabled() bool {
 	a.RLock()
 	defer a.RUnlock()
 
-	var channels []*channel.Channel
+	return a.Enabled
+}
 
-	for _, c := range a.channels {
-		if c.IsPresence() {
-			channels = append(channels, c)
-		}
-	}
+// AllowsUserEvents returns true if the clients can send client events
+func (a *Application) AllowsUserEvents() bool {
+	a.RLock()
+	defer a.RUnlock()
 
-	return channels
+	return a.UserEvents
 }
 
-// PrivateChannels Only Private channels
-func (a *Application) PrivateChannels() []*channel.Channel {
+// ActivityTimeoutDuration returns the current inactivity time before the server pings a connection
+func (a *Application) ActivityTimeoutDuration() time.Duration {
 	a.RLock()
 	defer a.RUnlock()
 
-	var channels []*channel.Channel
+	return time.Duration(a.ActivityTimeout) * time.Second
+}
+
+// copyStrings returns a copy of the slice, so the configuration does not share memory with the Application
+func copyStrings(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
 
-	for _, c := range a.channels {
-		if c.IsPrivate() {
-			channels = append(channels, c)
+	return append([]string(nil), s...)
+}
+
+// copyTargets returns a deep copy of the webhook targets
+func copyTargets(targets []config.WebhookTarget) []config.WebhookTarget {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	copied := make([]config.WebhookTarget, len(targets))
+
+	for i, t := range targets {
+		copied[i] = config.WebhookTarget{
+			URL:             t.URL,
+			Events:          copyStrings(t.Events),
+			ChannelPrefixes: copyStrings(t.ChannelPrefixes),
+		}
+
+		if t.Headers != nil {
+			copied[i].Headers = make(map[string]string, len(t.Headers))
+
+			for name, value := range t.Headers {
+				copied[i].Headers[name] = value
+			}
 		}
 	}
 
-	return channels
+	return copied
 }
 
-// PublicChannels Only Public channels
-func (a *Application) PublicChannels() []*channel.Channel {
+// PresenceLimits returns the current limits of the presence channels
+func (a *Application) PresenceLimits() channel.PresenceLimits {
+	a.RLock()
+	defer a.RUnlock()
+
+	return channel.PresenceLimits{
+		MaxMembers:      a.PresenceMaxMembers,
+		MaxUserInfoSize: a.PresenceMaxUserInfoSize,
+		MaxUserIDLength: a.PresenceMaxUserIDLength,
+	}
+}
+
+// vacateGracePeriod returns how long the channels wait before they are vacated
+func (a *Application) vacateGracePeriod() time.Duration {
+	a.RLock()
+	defer a.RUnlock()
+
+	return time.Duration(a.VacateGracePeriodMs) * time.Millisecond
+}
+
+// IsOriginAllowed Verify if a websocket connection with the given origin is allowed
+// Requests without the Origin header are not sent by browsers, so they are always allowed
+func (a *Application) IsOriginAllowed(origin string) bool {
 	a.RLock()
 	defer a.RUnlock()
 
-	var channels []*channel.Channel
+	if len(a.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
 
-	for _, c := range a.channels {
-		if c.IsPublic() {
-			channels = append(channels, c)
+	for _, pattern := range a.AllowedOrigins {
+		if utils.MatchOrigin(origin, pattern) {
+			return true
 		}
 	}
 
-	return channels
+	return false
+}
+
+// Channels returns the full list of channels
+func (a *Application) Channels() []*channel.Channel {
+	return a.channels.list(allChannels)
+}
+
+// PresenceChannels Only Presence channels
+func (a *Application) PresenceChannels() []*channel.Channel {
+	return a.channels.list(presenceChannels)
+}
+
+// PrivateChannels Only Private channels
+func (a *Application) PrivateChannels() []*channel.Channel {
+	return a.channels.list(privateChannels)
+}
+
+// PublicChannels Only Public channels
+func (a *Application) PublicChannels() []*channel.Channel {
+	return a.channels.list(publicChannels)
 }
 
 // Disconnect Socket
@@ -143,49 +416,152 @@ func (a *Application) Disconnect(socketID string) {
 		return
 	}
 
-	// Unsubscribe from channels
-	for _, c := range a.channels {
-		if c.IsSubscribed(conn) {
-			if err := c.Unsubscribe(conn); err != nil {
-				log.Errorf("error while calling Channel.Unsubscribe, %+v", err)
-				continue
-			}
+	// Unsubscribe only from the channels of the connection
+	for _, channelID := range conn.Channels() {
+		c, err := a.FindChannelByChannelID(channelID)
+
+		if err != nil {
+			conn.RemoveChannel(channelID)
+			continue
+		}
+
+		if err := a.Unsubscribe(c, conn); err != nil {
+			log.Errorf("error while calling Channel.Unsubscribe, %+v", err)
 		}
 	}
 
 	// Remove from Application
-	a.Lock()
-	_, exists := a.connections[conn.SocketID]
-	a.Unlock()
+	if a.connections.remove(conn.SocketID) {
+		a.Stats.Add("TotalConnections", -1)
+	}
+}
 
-	if !exists {
-		return
+// writeQueueDepth returns the total of messages waiting to be written to the connections
+func (a *Application) writeQueueDepth() interface{} {
+	total := 0
+
+	for _, conn := range a.connections.list() {
+		total += conn.QueueLength()
 	}
 
-	a.Lock()
-	delete(a.connections, conn.SocketID)
-	a.Unlock()
+	return total
+}
+
+// Terminate sends a pusher:error with the given code to the connection,
+// starts the close handshake with the same code and disconnects it from the Application
+func (a *Application) Terminate(conn *connection.Connection, code int, message string) {
+	log.Infof("terminating socket %s with code %d", conn.SocketID, code)
+
+	conn.Publish(events.NewError(code, message))
+	conn.CloseWithError(code, message)
+
+	a.Disconnect(conn.SocketID)
+}
+
+// FindConnectionsByUserID returns every connection signed in as the given user
+// or subscribed to a presence channel as the given user
+func (a *Application) FindConnectionsByUserID(userID string) []*connection.Connection {
+	var (
+		connections = a.signedInConnections(userID)
+		seen        = make(map[string]bool)
+	)
+
+	for _, conn := range connections {
+		seen[conn.SocketID] = true
+	}
+
+	for _, c := range a.PresenceChannels() {
+		for _, s := range c.Subscriptions() {
+			if s.ID == userID && !seen[s.Connection.SocketID] {
+				seen[s.Connection.SocketID] = true
+				connections = append(connections, s.Connection)
+			}
+		}
+	}
+
+	return connections
+}
+
+// signedInConnections returns the connections signed in as the given user
+func (a *Application) signedInConnections(userID string) []*connection.Connection {
+	var connections []*connection.Connection
+
+	if userID == "" {
+		return connections
+	}
+
+	for _, conn := range a.connections.list() {
+		if conn.UserID() == userID {
+			connections = append(connections, conn)
+		}
+	}
+
+	return connections
+}
+
+// SendToUser publishes the event to every connection signed in as the given user
+// the event is sent on the user's server to user channel
+// returns the number of connections that received the event
+func (a *Application) SendToUser(userID, event string, data json.RawMessage) (int, error) {
+	b, err := events.EncodeResponse(events.Raw{Event: event, Channel: utils.ServerToUserChannel(userID), Data: data})
+
+	if err != nil {
+		return 0, err
+	}
+
+	message, err := websocket.NewPreparedMessage(websocket.TextMessage, b)
+
+	if err != nil {
+		return 0, err
+	}
+
+	connections := a.signedInConnections(userID)
+
+	for _, conn := range connections {
+		conn.PublishPrepared(message)
+	}
+
+	a.Stats.Add("TotalUniqueMessages", 1)
+
+	return len(connections), nil
+}
+
+// TerminateUserConnections terminates every connection of the given user
+// returns the number of terminated connections
+func (a *Application) TerminateUserConnections(userID string) int {
+	connections := a.FindConnectionsByUserID(userID)
+
+	for _, conn := range connections {
+		a.Terminate(conn, 4009, "Connection terminated by the server")
+	}
 
-	a.Stats.Add("TotalConnections", -1)
+	return len(connections)
+}
+
+// TerminateAllConnections terminates every connection of this Application
+// returns the number of terminated connections
+func (a *Application) TerminateAllConnections(code int, message string) int {
+	connections := a.connections.list()
+
+	for _, conn := range connections {
+		a.Terminate(conn, code, message)
+	}
+
+	return len(connections)
 }
 
 // Connect a new Subscriber
 func (a *Application) Connect(conn *connection.Connection) {
-	log.Infof("adding a new Connection %s to Application %s", conn.SocketID, a.Name)
-	a.Lock()
-	defer a.Unlock()
+	log.Infof("adding a new Connection %s to Application %s", conn.SocketID, a.AppID)
 
-	a.connections[conn.SocketID] = conn
+	a.connections.add(conn)
 
 	a.Stats.Add("TotalConnections", 1)
 }
 
 // FindConnection Find a Connection on this Application
 func (a *Application) FindConnection(socketID string) (*connection.Connection, error) {
-	a.RLock()
-	defer a.RUnlock()
-
-	conn, exists := a.connections[socketID]
+	conn, exists := a.connections.get(socketID)
 
 	if exists {
 		return conn, nil
@@ -196,11 +572,22 @@ func (a *Application) FindConnection(socketID string) (*connection.Connection, e
 
 // RemoveChannel removes the Channel from Application
 func (a *Application) RemoveChannel(c *channel.Channel) {
-	log.Infof("remove the Channel %s from Application %s", c.ID, a.Name)
-	a.Lock()
-	defer a.Unlock()
+	s := a.channels.shard(c.ID)
 
-	delete(a.channels, c.ID)
+	s.Lock()
+	defer s.Unlock()
+
+	a.removeChannel(s, c)
+}
+
+// removeChannel removes the channel from the shard and updates the stats
+// the caller must hold the lock of the shard
+func (a *Application) removeChannel(s *channelShard, c *channel.Channel) {
+	log.Infof("remove the Channel %s from Application %s", c.ID, a.AppID)
+
+	if !s.remove(c.ID) {
+		return
+	}
 
 	if c.IsPresence() {
 		a.Stats.Add("TotalPresenceChannels", -1)
@@ -219,12 +606,25 @@ func (a *Application) RemoveChannel(c *channel.Channel) {
 
 // AddChannel Add a new Channel to this APP
 func (a *Application) AddChannel(c *channel.Channel) {
-	log.Infof("adding a new Channel %s to Application %s", c.ID, a.Name)
+	s := a.channels.shard(c.ID)
 
-	a.Lock()
-	defer a.Unlock()
+	s.Lock()
+	defer s.Unlock()
 
-	a.channels[c.ID] = c
+	a.addChannel(s, c)
+}
+
+// addChannel adds the channel into the shard and updates the stats
+// the caller must hold the lock of the shard
+func (a *Application) addChannel(s *channelShard, c *channel.Channel) {
+	log.Infof("adding a new Channel %s to Application %s", c.ID, a.AppID)
+
+	_, replaced := s.get(c.ID)
+	s.add(c)
+
+	if replaced {
+		return
+	}
 
 	if c.IsPresence() {
 		a.Stats.Add("TotalPresenceChannels", 1)
@@ -254,6 +654,9 @@ func (a *Application) FindOrCreateChannelByChannelID(n string) *channel.Channel
 			}),
 			channel.WithChannelVacatedListener(func(c *channel.Channel, s *subscription.Subscription) {
 				a.TriggerChannelVacatedHook(c)
+
+				// After a grace period nobody else removes the channel
+				a.removeChannelIfVacant(c)
 			}),
 			channel.WithMemberAddedListener(func(c *channel.Channel, s *subscription.Subscription) {
 				a.TriggerMemberAddedHook(c, s)
@@ -264,8 +667,28 @@ func (a *Application) FindOrCreateChannelByChannelID(n string) *channel.Channel
 			channel.WithClientEventListener(func(c *channel.Channel, s *subscription.Subscription, event string, data interface{}) {
 				a.TriggerClientEventHook(c, s, event, data)
 			}),
+			channel.WithCacheMissListener(func(c *channel.Channel, s *subscription.Subscription) {
+				a.TriggerCacheMissHook(c)
+			}),
+			channel.WithCacheExpiredListener(func(c *channel.Channel, s *subscription.Subscription) {
+				// An empty cache channel is only kept while it remembers the event
+				a.removeChannelIfVacant(c)
+			}),
+			channel.WithCacheTTL(a.cacheTTL),
+			channel.WithPresenceLimits(a.PresenceLimits),
+			channel.WithVacateGracePeriod(a.vacateGracePeriod),
 		)
-		a.AddChannel(c)
+
+		// Other connection may have created the same channel in the meantime
+		s := a.channels.shard(n)
+
+		s.Lock()
+		if existing, exists := s.get(n); exists {
+			c = existing
+		} else {
+			a.addChannel(s, c)
+		}
+		s.Unlock()
 	}
 
 	return c
@@ -273,10 +696,12 @@ func (a *Application) FindOrCreateChannelByChannelID(n string) *channel.Channel
 
 // FindChannelByChannelID Find the Channel by Channel ID
 func (a *Application) FindChannelByChannelID(n string) (*channel.Channel, error) {
-	a.RLock()
-	defer a.RUnlock()
+	s := a.channels.shard(n)
+
+	s.RLock()
+	defer s.RUnlock()
 
-	c, exists := a.channels[n]
+	c, exists := s.get(n)
 
 	if exists {
 		return c, nil
@@ -295,20 +720,62 @@ func (a *Application) Publish(c *channel.Channel, event events.Raw, ignore strin
 
 // Unsubscribe unsubscribe the given connection from the channel
 // remove the channel from the application if it is empty
+// cache channels are kept while they remember an event
 func (a *Application) Unsubscribe(c *channel.Channel, conn *connection.Connection) error {
 	err := c.Unsubscribe(conn)
 	if err != nil {
 		return err
 	}
 
-	if !c.IsOccupied() {
-		a.RemoveChannel(c)
-	}
+	a.removeChannelIfVacant(c)
 
 	return nil
 }
 
 // Subscribe the connection into the given channel
+// The channel is removed if the subscription is refused and nobody else is subscribed
+//
+// The channel may have been vacated and removed by other connection after it was found,
+// so the subscription is always made into the channel registered in the Application.
 func (a *Application) Subscribe(c *channel.Channel, conn *connection.Connection, data string) error {
-	return c.Subscribe(conn, data)
+	s := a.channels.shard(c.ID)
+
+	s.Lock()
+	if registered, exists := s.get(c.ID); exists {
+		c = registered
+	} else {
+		a.addChannel(s, c)
+	}
+	s.subscribing[c.ID]++
+	s.Unlock()
+
+	err := c.Subscribe(conn, data)
+
+	s.Lock()
+	if s.subscribing[c.ID]--; s.subscribing[c.ID] == 0 {
+		delete(s.subscribing, c.ID)
+	}
+	s.Unlock()
+
+	if err != nil {
+		a.removeChannelIfVacant(c)
+	}
+
+	return err
+}
+
+// removeChannelIfVacant removes the channel if it does not have subscribers
+// cache channels are kept while they remember an event, they are checked again when it expires
+// the channels in the vacate grace period are kept so a new subscription can cancel the vacate
+func (a *Application) removeChannelIfVacant(c *channel.Channel) {
+	s := a.channels.shard(c.ID)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if registered, _ := s.get(c.ID); registered != c || s.subscribing[c.ID] > 0 || c.IsOccupied() || c.IsVacating() || c.HasCachedEvent() {
+		return
+	}
+
+	a.removeChannel(s, c)
 }
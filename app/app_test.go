@@ -5,11 +5,17 @@
 package app
 
 import (
+	"fmt"
+	"reflect"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	channel2 "ipe/channel"
+	"ipe/config"
 	"ipe/connection"
+	"ipe/events"
 	"ipe/mocks"
 )
 
@@ -27,8 +33,8 @@ func TestConnect(t *testing.T) {
 
 	app.Connect(connection.New("socketID", mocks.MockSocket{}))
 
-	if len(app.connections) != 1 {
-		t.Errorf("len(Application.connections) == %d, wants %d", len(app.connections), 1)
+	if app.connections.len() != 1 {
+		t.Errorf("len(Application.connections) == %d, wants %d", app.connections.len(), 1)
 	}
 
 }
@@ -39,8 +45,8 @@ func TestDisconnect(t *testing.T) {
 	app.Connect(connection.New("socketID", mocks.MockSocket{}))
 	app.Disconnect("socketID")
 
-	if len(app.connections) != 0 {
-		t.Errorf("len(Application.connections) == %d, wants %d", len(app.connections), 0)
+	if app.connections.len() != 0 {
+		t.Errorf("len(Application.connections) == %d, wants %d", app.connections.len(), 0)
 	}
 
 }
@@ -74,14 +80,14 @@ func TestFindChannelByChannelID(t *testing.T) {
 func TestFindOrCreateChannelByChannelID(t *testing.T) {
 	app := newTestApp()
 
-	if len(app.channels) != 0 {
-		t.Errorf("len(Application.channels) == %d, wants %d", len(app.channels), 0)
+	if app.channels.len() != 0 {
+		t.Errorf("len(Application.channels) == %d, wants %d", app.channels.len(), 0)
 	}
 
 	app.FindOrCreateChannelByChannelID("ID")
 
-	if len(app.channels) != 1 {
-		t.Errorf("len(Application.channels) == %d, wants %d", len(app.channels), 1)
+	if app.channels.len() != 1 {
+		t.Errorf("len(Application.channels) == %d, wants %d", app.channels.len(), 1)
 	}
 
 }
@@ -89,21 +95,21 @@ func TestFindOrCreateChannelByChannelID(t *testing.T) {
 func TestRemoveChannel(t *testing.T) {
 	app := newTestApp()
 
-	if len(app.channels) != 0 {
-		t.Errorf("len(Application.channels) == %d, wants %d", len(app.channels), 0)
+	if app.channels.len() != 0 {
+		t.Errorf("len(Application.channels) == %d, wants %d", app.channels.len(), 0)
 	}
 
 	channel := channel2.New("ID")
 	app.AddChannel(channel)
 
-	if len(app.channels) != 1 {
-		t.Errorf("len(Application.channels) == %d, wants %d", len(app.channels), 1)
+	if app.channels.len() != 1 {
+		t.Errorf("len(Application.channels) == %d, wants %d", app.channels.len(), 1)
 	}
 
 	app.RemoveChannel(channel)
 
-	if len(app.channels) != 0 {
-		t.Errorf("len(Application.channels) == %d, wants %d", len(app.channels), 0)
+	if app.channels.len() != 0 {
+		t.Errorf("len(Application.channels) == %d, wants %d", app.channels.len(), 0)
 	}
 
 }
@@ -156,23 +162,23 @@ func Test_AllChannels(t *testing.T) {
 	app.AddChannel(channel2.New("presence-test"))
 	app.AddChannel(channel2.New("test"))
 
-	if len(app.channels) != 3 {
-		t.Errorf("len(Application.channels) == %d, wants %d", len(app.channels), 3)
+	if app.channels.len() != 3 {
+		t.Errorf("len(Application.channels) == %d, wants %d", app.channels.len(), 3)
 	}
 }
 
 func Test_New_Subscriber(t *testing.T) {
 	app := newTestApp()
 
-	if len(app.connections) != 0 {
-		t.Errorf("len(Application.connections) == %d, wants %d", len(app.connections), 0)
+	if app.connections.len() != 0 {
+		t.Errorf("len(Application.connections) == %d, wants %d", app.connections.len(), 0)
 	}
 
 	conn := connection.New("1", mocks.MockSocket{})
 	app.Connect(conn)
 
-	if len(app.connections) != 1 {
-		t.Errorf("len(Application.connections) == %d, wants %d", len(app.connections), 1)
+	if app.connections.len() != 1 {
+		t.Errorf("len(Application.connections) == %d, wants %d", app.connections.len(), 1)
 	}
 }
 
@@ -200,7 +206,7 @@ func Test_find_subscriber(t *testing.T) {
 	}
 
 	if conn != nil {
-		t.Errorf("conn == %q, wants nil", conn)
+		t.Errorf("conn == %v, wants nil", conn)
 	}
 }
 
@@ -253,3 +259,362 @@ func Test_find_or_create_channels(t *testing.T) {
 	}
 
 }
+
+func TestTerminateUserConnections(t *testing.T) {
+	app := newTestApp()
+	c := app.FindOrCreateChannelByChannelID("presence-test")
+
+	for i, userID := range []string{"1", "1", "2"} {
+		conn := connection.New(strconv.Itoa(i), mocks.MockSocket{})
+		app.Connect(conn)
+
+		if err := app.Subscribe(c, conn, `{"user_id":"`+userID+`","user_info":{}}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if total := app.TerminateUserConnections("1"); total != 2 {
+		t.Errorf("Application.TerminateUserConnections('1') == %d, wants %d", total, 2)
+	}
+
+	if app.connections.len() != 1 {
+		t.Errorf("len(Application.connections) == %d, wants %d", app.connections.len(), 1)
+	}
+
+	if c.TotalSubscriptions() != 1 {
+		t.Errorf("c.TotalSubscriptions() == %d, wants %d", c.TotalSubscriptions(), 1)
+	}
+}
+
+func TestNewApplication_same_name_twice(t *testing.T) {
+	a := NewApplication("Twice", "twice", "123", "123", false, true, true, false, "")
+	a.Stats.Add("TotalConnections", 1)
+
+	b := NewApplication("Twice", "twice", "123", "123", false, true, true, false, "")
+
+	if b.Stats.Get("TotalConnections") != nil {
+		t.Errorf("b.Stats.Get('TotalConnections') == %v, wants %v", b.Stats.Get("TotalConnections"), nil)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	app := newTestApp()
+
+	c := app.Config()
+	c.Name = "Configured"
+	c.Enabled = true
+	c.WebHooks.URL = "http://127.0.0.1/hook"
+	c.AllowedOrigins = []string{"https://example.com"}
+
+	app.Configure(c)
+
+	if !reflect.DeepEqual(app.Config(), c) {
+		t.Errorf("app.Config() == %+v, wants %+v", app.Config(), c)
+	}
+}
+
+func TestNewApplicationFromConfig_webhook_max_retries(t *testing.T) {
+	noRetries := 0
+
+	testCases := []struct {
+		maxRetries *int
+		expected   int
+	}{
+		{nil, DefaultWebhookMaxRetries},
+		{&noRetries, 0},
+	}
+
+	for _, tc := range testCases {
+		c := config.Application{Name: "Retries", AppID: "retries", Key: "123", Secret: "123"}
+		c.WebHooks.MaxRetries = tc.maxRetries
+
+		if a := NewApplicationFromConfig(c); a.WebhookMaxRetries != tc.expected {
+			t.Errorf("a.WebhookMaxRetries == %d, wants %d", a.WebhookMaxRetries, tc.expected)
+		}
+	}
+}
+
+func TestSendToUser(t *testing.T) {
+	app := newTestApp()
+
+	for i, userID := range []string{"1", "1", "2", ""} {
+		conn := connection.New(strconv.Itoa(i), mocks.MockSocket{})
+		conn.SignIn(userID)
+		app.Connect(conn)
+	}
+
+	total, err := app.SendToUser("1", "event", []byte(`"{}"`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 2 {
+		t.Errorf("Application.SendToUser('1', ...) == %d, wants %d", total, 2)
+	}
+
+	if _, err := app.SendToUser("1", "event", []byte(`invalid`)); err == nil {
+		t.Errorf("Application.SendToUser('1', 'event', 'invalid') == _, %v, wants !nil", err)
+	}
+
+	if total := len(app.FindConnectionsByUserID("2")); total != 1 {
+		t.Errorf("len(Application.FindConnectionsByUserID('2')) == %d, wants %d", total, 1)
+	}
+}
+
+func TestSendToUser_empty_user(t *testing.T) {
+	app := newTestApp()
+	app.Connect(connection.New("1", mocks.MockSocket{}))
+
+	if total, _ := app.SendToUser("", "event", []byte(`"{}"`)); total != 0 {
+		t.Errorf("Application.SendToUser('', ...) == %d, wants %d", total, 0)
+	}
+}
+
+func TestUnsubscribe_keeps_cache_channels(t *testing.T) {
+	app := newTestApp()
+	conn := connection.New("1", mocks.MockSocket{})
+	app.Connect(conn)
+
+	c := app.FindOrCreateChannelByChannelID("cache-test")
+	_ = app.Subscribe(c, conn, "")
+	_ = app.Publish(c, events.Raw{Event: "event", Channel: c.ID, Data: []byte(`"{}"`)}, "")
+	_ = app.Unsubscribe(c, conn)
+
+	if _, err := app.FindChannelByChannelID("cache-test"); err != nil {
+		t.Errorf("Application.FindChannelByChannelID('cache-test') == _, %v, wants nil", err)
+	}
+
+	c = app.FindOrCreateChannelByChannelID("test")
+	_ = app.Subscribe(c, conn, "")
+	_ = app.Unsubscribe(c, conn)
+
+	if _, err := app.FindChannelByChannelID("test"); err == nil {
+		t.Errorf("Application.FindChannelByChannelID('test') == _, %v, wants !nil", err)
+	}
+}
+
+func TestCacheChannel_removed_after_the_ttl(t *testing.T) {
+	app := newTestApp()
+	app.cacheTTL = 50 * time.Millisecond
+
+	conn := connection.New("1", mocks.MockSocket{})
+	app.Connect(conn)
+
+	c := app.FindOrCreateChannelByChannelID("cache-ttl")
+	_ = app.Publish(c, events.Raw{Event: "event", Channel: c.ID, Data: []byte(`"{}"`)}, "")
+	_ = app.Subscribe(c, conn, "")
+	app.Disconnect(conn.SocketID)
+
+	if _, err := app.FindChannelByChannelID("cache-ttl"); err != nil {
+		t.Errorf("Application.FindChannelByChannelID('cache-ttl') == _, %v, wants nil", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+
+	for time.Now().Before(deadline) {
+		if _, err := app.FindChannelByChannelID("cache-ttl"); err != nil {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("the cache channel was not removed after the ttl")
+}
+
+func TestIsOriginAllowed(t *testing.T) {
+	app := newTestApp()
+
+	if !app.IsOriginAllowed("https://example.com") {
+		t.Errorf("app.IsOriginAllowed(%s) == %t, wants %t", "https://example.com", false, true)
+	}
+
+	app.AllowedOrigins = []string{"*.example.com", "https://example.org"}
+
+	testCases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://app.example.com", true},
+		{"https://example.org", true},
+		{"http://example.org", false},
+		{"https://evil.com", false},
+	}
+
+	for _, tc := range testCases {
+		if allowed := app.IsOriginAllowed(tc.origin); allowed != tc.allowed {
+			t.Errorf("app.IsOriginAllowed(%s) == %t, wants %t", tc.origin, allowed, tc.allowed)
+		}
+	}
+}
+
+func TestDisconnect_removes_vacated_channels(t *testing.T) {
+	app := newTestApp()
+
+	conn := connection.New("1", mocks.MockSocket{})
+	other := connection.New("2", mocks.MockSocket{})
+	app.Connect(conn)
+	app.Connect(other)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := app.Subscribe(app.FindOrCreateChannelByChannelID(name), conn, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := app.Subscribe(app.FindOrCreateChannelByChannelID("a"), other, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conn.Channels()) != 3 {
+		t.Errorf("len(conn.Channels()) == %d, wants %d", len(conn.Channels()), 3)
+	}
+
+	app.Disconnect(conn.SocketID)
+
+	if len(app.Channels()) != 1 {
+		t.Errorf("len(app.Channels()) == %d, wants %d", len(app.Channels()), 1)
+	}
+
+	if len(conn.Channels()) != 0 {
+		t.Errorf("len(conn.Channels()) == %d, wants %d", len(conn.Channels()), 0)
+	}
+
+	if _, err := app.FindChannelByChannelID("a"); err != nil {
+		t.Errorf("app.FindChannelByChannelID(%s) == %v, wants %v", "a", err, nil)
+	}
+}
+
+func TestConnections_concurrent_churn(t *testing.T) {
+	app := newTestApp()
+
+	var (
+		wg       sync.WaitGroup
+		channels = []string{"a", "b", "presence-c", "private-d"}
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				conn := connection.New(fmt.Sprintf("%d.%d", i, j), mocks.MockSocket{})
+				app.Connect(conn)
+
+				for k, name := range channels {
+					if (i+j+k)%2 == 0 {
+						continue
+					}
+
+					c := app.FindOrCreateChannelByChannelID(name)
+
+					if err := app.Subscribe(c, conn, fmt.Sprintf(`{"user_id":"%d"}`, i)); err != nil {
+						t.Error(err)
+					}
+
+					_ = app.Publish(c, events.Raw{Event: "event", Channel: name, Data: []byte(`"{}"`)}, "")
+				}
+
+				app.Disconnect(conn.SocketID)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if len(app.Channels()) != 0 {
+		t.Errorf("len(app.Channels()) == %d, wants %d", len(app.Channels()), 0)
+	}
+
+	if total := app.Stats.Get("TotalChannels").String(); total != "0" {
+		t.Errorf("TotalChannels == %s, wants %s", total, "0")
+	}
+
+	if total := app.Stats.Get("TotalConnections").String(); total != "0" {
+		t.Errorf("TotalConnections == %s, wants %s", total, "0")
+	}
+}
+
+func TestUnsubscribe_vacate_grace_period(t *testing.T) {
+	app := newTestApp()
+	app.VacateGracePeriodMs = 50
+
+	conn := connection.New("1", mocks.MockSocket{})
+	app.Connect(conn)
+
+	c := app.FindOrCreateChannelByChannelID("hello")
+
+	if err := app.Subscribe(c, conn, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Unsubscribe(c, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if app.channels.len() != 1 {
+		t.Errorf("app.channels.len() == %d, wants %d", app.channels.len(), 1)
+	}
+
+	// The same channel is found again, so the pending vacate is cancelled
+	if found := app.FindOrCreateChannelByChannelID("hello"); found != c {
+		t.Errorf("FindOrCreateChannelByChannelID('hello') == %p, wants %p", found, c)
+	}
+
+	if err := app.Subscribe(c, conn, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Unsubscribe(c, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+
+	for app.channels.len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if app.channels.len() != 0 {
+		t.Errorf("app.channels.len() == %d, wants %d", app.channels.len(), 0)
+	}
+}
+
+func TestConfigure_concurrent_readers(t *testing.T) {
+	app := newTestApp()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			c := app.Config()
+			c.Key = strconv.Itoa(i)
+			c.Enabled = i%2 == 0
+			app.Configure(c)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			app.Credentials()
+			app.IsEnabled()
+			app.AllowsUserEvents()
+			app.ActivityTimeoutDuration()
+		}
+	}()
+
+	wg.Wait()
+
+	if key, _ := app.Credentials(); key != "99" {
+		t.Errorf("app.Credentials() == %s, _, wants %s", key, "99")
+	}
+}
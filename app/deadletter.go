@@ -0,0 +1,214 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// DeadLetter a webhook that could not be delivered
+// The dead letter file has one DeadLetter encoded as JSON per line
+type DeadLetter struct {
+	AppID    string          `json:"app_id"`
+	URL      string          `json:"url,omitempty"`
+	FailedAt time.Time       `json:"failed_at"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+var (
+	deadLetterMutex    sync.Mutex
+	deadLetterFilename string
+)
+
+// SetDeadLetterFile sets the file where the webhooks that could not be delivered are appended
+// The webhooks are only logged if the filename is empty
+func SetDeadLetterFile(filename string) {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+
+	deadLetterFilename = filename
+}
+
+// appendDeadLetter appends the payload to the dead letter file, if there is one
+func appendDeadLetter(appID, url string, payload []byte, attempts int, cause error) error {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+
+	if deadLetterFilename == "" {
+		return nil
+	}
+
+	return writeDeadLetters(deadLetterFilename, DeadLetter{
+		AppID:    appID,
+		URL:      url,
+		FailedAt: time.Now(),
+		Attempts: attempts,
+		Error:    cause.Error(),
+		Payload:  payload,
+	})
+}
+
+// writeDeadLetters appends the dead letters to the file, creating it if needed
+func writeDeadLetters(filename string, letters ...DeadLetter) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+
+	for _, letter := range letters {
+		if err := encoder.Encode(letter); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// ReplayDeadLetters delivers again the webhooks of the dead letter file
+//
+// Each webhook is sent to the url it failed, with the headers currently configured for it.
+// The file is moved away before the replay, so the server can keep appending to it,
+// the webhooks that fail again, or whose app does not exist, are appended back to the file.
+// It returns the number of delivered and failed webhooks.
+func ReplayDeadLetters(filename string, find func(appID string) (*Application, error)) (delivered, failed int, err error) {
+	return readDeadLetters(filename, find, func(application *Application, letter *DeadLetter) bool {
+		attempts, err := deliverHook(application, application.webhookTarget(letter.URL), letter.Payload, backoff)
+
+		if err != nil {
+			log.Errorf("replaying webhook of app %s: %+v", letter.AppID, err)
+
+			letter.FailedAt = time.Now()
+			letter.Attempts += attempts
+			letter.Error = err.Error()
+			return false
+		}
+
+		return true
+	})
+}
+
+// QueueDeadLetters queues again the webhooks of the dead letter file, without waiting them to be delivered
+//
+// The webhooks are delivered in background by the dispatcher of their app, with the usual retries,
+// the ones that fail again are appended back to the dead letter file.
+// The webhooks whose app does not exist or that can not be queued are kept in the file.
+// It returns the number of queued and kept webhooks.
+func QueueDeadLetters(filename string, find func(appID string) (*Application, error)) (queued, kept int, err error) {
+	return readDeadLetters(filename, find, func(application *Application, letter *DeadLetter) bool {
+		hook := &pendingHook{
+			target:  application.webhookTarget(letter.URL),
+			payload: letter.Payload,
+			events:  countHookEvents(letter.Payload),
+		}
+
+		if !application.webhooks.requeue(hook) {
+			log.Errorf("replaying webhook of app %s: the webhook could not be queued", letter.AppID)
+			return false
+		}
+
+		return true
+	})
+}
+
+// countHookEvents returns the number of events of the webhook payload
+func countHookEvents(payload []byte) int64 {
+	var hook struct {
+		Events []json.RawMessage `json:"events"`
+	}
+
+	if err := json.Unmarshal(payload, &hook); err != nil {
+		return 0
+	}
+
+	return int64(len(hook.Events))
+}
+
+// readDeadLetters calls replay with each webhook of the dead letter file and the app it belongs to
+//
+// The file is moved away before, so the server can keep appending to it.
+// The webhooks replay returns false for, or whose app does not exist, are appended back to the file.
+// The url of the webhooks written before the targets existed is set to the url of the app.
+func readDeadLetters(filename string, find func(appID string) (*Application, error), replay func(*Application, *DeadLetter) bool) (replayed, remaining int, err error) {
+	replaying := fmt.Sprintf("%s.replaying.%d", filename, time.Now().UnixNano())
+
+	if err := os.Rename(filename, replaying); err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+
+		return 0, 0, err
+	}
+
+	f, err := os.Open(replaying)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var kept []DeadLetter
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for scanner.Scan() {
+		var letter DeadLetter
+
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			log.Errorf("skipping invalid dead letter %q: %+v", scanner.Text(), err)
+			continue
+		}
+
+		application, err := find(letter.AppID)
+
+		if err != nil {
+			log.Errorf("replaying webhook of app %s: %+v", letter.AppID, err)
+			kept = append(kept, letter)
+			continue
+		}
+
+		if letter.URL == "" {
+			letter.URL = application.Config().WebHooks.URL
+		}
+
+		if !replay(application, &letter) {
+			kept = append(kept, letter)
+			continue
+		}
+
+		replayed++
+	}
+
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return replayed, len(kept), fmt.Errorf("reading %s: %+v, the remaining webhooks were kept in it", replaying, err)
+	}
+
+	f.Close()
+
+	if len(kept) > 0 {
+		deadLetterMutex.Lock()
+		err = writeDeadLetters(filename, kept...)
+		deadLetterMutex.Unlock()
+
+		if err != nil {
+			return replayed, len(kept), fmt.Errorf("writing back the failed webhooks: %+v, they were kept in %s", err, replaying)
+		}
+	}
+
+	return replayed, len(kept), os.Remove(replaying)
+}
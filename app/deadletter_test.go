@@ -0,0 +1,79 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayDeadLetters(t *testing.T) {
+	var received []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(body))
+	}))
+	defer server.Close()
+
+	app := newTestWebhookApp(server.URL)
+	app.WebhookMaxRetries = 0
+	defer app.StopWebhooks()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead-letter.log")
+	SetDeadLetterFile(deadLetter)
+	defer SetDeadLetterFile("")
+
+	payload := `{"time_ms":1,"events":[{"name":"channel_vacated","channel":"hello"}]}`
+
+	if err := appendDeadLetter(app.AppID, server.URL, []byte(payload), 4, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := appendDeadLetter("unknown", server.URL, []byte(payload), 4, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(appID string) (*Application, error) {
+		if appID == app.AppID {
+			return app, nil
+		}
+
+		return nil, errors.New("app not found")
+	}
+
+	delivered, failed, err := ReplayDeadLetters(deadLetter, find)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delivered != 1 || failed != 1 {
+		t.Errorf("ReplayDeadLetters(...) == %d, %d, wants %d, %d", delivered, failed, 1, 1)
+	}
+
+	if len(received) != 1 || received[0] != payload {
+		t.Errorf("received == %v, wants [%s]", received, payload)
+	}
+
+	data, err := ioutil.ReadFile(deadLetter)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(data), "\n"); lines != 1 || !strings.Contains(string(data), `"app_id":"unknown"`) {
+		t.Errorf("dead letter file == %s, wants only the unknown app", data)
+	}
+
+	if files, _ := filepath.Glob(deadLetter + ".replaying.*"); len(files) != 0 {
+		t.Errorf("replaying files == %v, wants none", files)
+	}
+}
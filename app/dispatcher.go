@@ -0,0 +1,311 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"ipe/config"
+)
+
+const (
+	// Webhook events waiting to be delivered, the new events are dropped when the queue is full
+	webhookQueueSize = 1000
+
+	// Number of goroutines delivering the webhooks of each Application
+	webhookWorkers = 4
+
+	// Webhooks waiting to be retried or replayed, the failures are dead lettered without retrying when it is reached
+	webhookMaxPendingRetries = 1000
+)
+
+// pendingHook a webhook to a target, with the attempts already made
+type pendingHook struct {
+	target   config.WebhookTarget
+	payload  []byte
+	events   int64
+	attempts int
+}
+
+// webhookDispatcher delivers the webhooks of an Application in background
+//
+// The workers are started with the first event and stopped when the Application is removed.
+// A failed delivery does not block its worker, it waits the retry delay apart and is queued again.
+type webhookDispatcher struct {
+	app     *Application
+	queue   chan hookEvent
+	retries chan *pendingHook
+	pending int32
+
+	// Delay before each retry of a failed delivery
+	delay func(retry int) time.Duration
+
+	mutex   sync.Mutex
+	started bool
+	stopped bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newWebhookDispatcher(a *Application) *webhookDispatcher {
+	return &webhookDispatcher{
+		app:     a,
+		queue:   make(chan hookEvent, webhookQueueSize),
+		retries: make(chan *pendingHook),
+		delay:   backoff,
+		done:    make(chan struct{}),
+	}
+}
+
+// enqueue the event without blocking, returns false if it was dropped
+func (d *webhookDispatcher) enqueue(event hookEvent) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.stopped {
+		return false
+	}
+
+	d.start()
+
+	select {
+	case d.queue <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// requeue queues a webhook that was already encoded, like the dead lettered ones,
+// it is delivered by the workers with the usual retries
+// returns false if the dispatcher was stopped or too many webhooks are waiting
+func (d *webhookDispatcher) requeue(hook *pendingHook) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.stopped {
+		return false
+	}
+
+	d.start()
+
+	return d.schedule(hook, 0, errors.New("the webhooks were stopped before the delivery"))
+}
+
+// start the workers if they are not running, the caller must hold the lock
+func (d *webhookDispatcher) start() {
+	if d.started {
+		return
+	}
+
+	d.started = true
+
+	for i := 0; i < webhookWorkers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+}
+
+// stop the workers and wait them to finish the events being delivered
+// the pending retries are dead lettered and the events still in the queue are discarded
+func (d *webhookDispatcher) stop() {
+	d.mutex.Lock()
+
+	if d.stopped {
+		d.mutex.Unlock()
+		return
+	}
+
+	d.stopped = true
+	close(d.done)
+	d.mutex.Unlock()
+
+	d.wg.Wait()
+}
+
+// depth returns the number of events waiting to be delivered
+func (d *webhookDispatcher) depth() int {
+	return len(d.queue)
+}
+
+func (d *webhookDispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case event := <-d.queue:
+			d.deliver(d.collect(event))
+		case hook := <-d.retries:
+			d.attempt(hook)
+		}
+	}
+}
+
+// collect returns a batch starting with the given event
+//
+// The events already queued are added to the batch up to the batch size,
+// if there is a batch window it waits for more events until the window is closed.
+func (d *webhookDispatcher) collect(event hookEvent) []hookEvent {
+	size, window := d.app.webhookBatchConfig()
+	batch := []hookEvent{event}
+
+	if window <= 0 {
+		for len(batch) < size {
+			select {
+			case event := <-d.queue:
+				batch = append(batch, event)
+			default:
+				return batch
+			}
+		}
+
+		return batch
+	}
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+
+	for len(batch) < size {
+		select {
+		case event := <-d.queue:
+			batch = append(batch, event)
+		case <-timer.C:
+			return batch
+		case <-d.done:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// deliver the events to each target as a single webhook, the targets are delivered concurrently
+// the events accepted by no target are only counted
+func (d *webhookDispatcher) deliver(batch []hookEvent) {
+	log.Infof("Triggering %d events, first %s", len(batch), batch[0].Name)
+
+	targets := d.app.webhookTargets()
+
+	if unmatched := countUnmatched(targets, batch); unmatched > 0 {
+		d.app.Stats.Add("TotalWebhooksUnmatched", unmatched)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, target := range targets {
+		events := filterHooks(target, batch)
+
+		if len(events) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(target config.WebhookTarget, events []hookEvent) {
+			defer wg.Done()
+			d.deliverTo(target, events)
+		}(target, events)
+	}
+
+	wg.Wait()
+}
+
+// deliverTo sends the events to the target
+func (d *webhookDispatcher) deliverTo(target config.WebhookTarget, events []hookEvent) {
+	total := int64(len(events))
+	payload, err := encodeHook(events...)
+
+	if err != nil {
+		d.app.Stats.Add("TotalWebhooksFailed", total)
+		log.Errorf("triggering webhook %+v", err)
+		return
+	}
+
+	d.attempt(&pendingHook{target: target, payload: payload, events: total})
+}
+
+// attempt to deliver the webhook, it is retried later if it fails and there are retries left
+func (d *webhookDispatcher) attempt(hook *pendingHook) {
+	err := attemptHook(d.app, hook.target, hook.payload)
+	hook.attempts++
+
+	if err == nil {
+		d.app.Stats.Add("TotalWebhooksDelivered", hook.events)
+		d.app.Stats.Add("TotalWebhookRequests", 1)
+		return
+	}
+
+	if hook.attempts > d.app.webhookMaxRetries() {
+		d.fail(hook, err)
+		return
+	}
+
+	log.Warningf("delivering webhook of app %s to %s, attempt %d failed: %+v", d.app.AppID, hook.target.URL, hook.attempts, err)
+
+	d.retry(hook, err)
+}
+
+// retry queues the webhook again after the retry delay, without holding a worker while waiting
+// it is dead lettered if the dispatcher is stopped before
+func (d *webhookDispatcher) retry(hook *pendingHook, cause error) {
+	if !d.schedule(hook, d.delay(hook.attempts), cause) {
+		d.fail(hook, fmt.Errorf("too many webhooks waiting to be retried, last error: %+v", cause))
+	}
+}
+
+// schedule queues the webhook for the workers after the delay, returns false if too many webhooks are waiting
+// if the dispatcher is stopped before, the webhook is dead lettered with the given cause
+//
+// It must be called by a worker or holding the lock of a running dispatcher,
+// so the dispatcher is not stopped before it waits the webhook.
+func (d *webhookDispatcher) schedule(hook *pendingHook, delay time.Duration, cause error) bool {
+	if atomic.AddInt32(&d.pending, 1) > webhookMaxPendingRetries {
+		atomic.AddInt32(&d.pending, -1)
+		return false
+	}
+
+	d.wg.Add(1)
+
+	go func() {
+		defer d.wg.Done()
+		defer atomic.AddInt32(&d.pending, -1)
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-d.done:
+			d.fail(hook, cause)
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case d.retries <- hook:
+		case <-d.done:
+			d.fail(hook, cause)
+		}
+	}()
+
+	return true
+}
+
+// fail appends the webhook to the dead letter file, all the attempts failed
+func (d *webhookDispatcher) fail(hook *pendingHook, cause error) {
+	d.app.Stats.Add("TotalWebhooksFailed", hook.events)
+	log.Errorf("triggering webhook to %s after %d attempts %+v", hook.target.URL, hook.attempts, cause)
+
+	if err := appendDeadLetter(d.app.AppID, hook.target.URL, hook.payload, hook.attempts, cause); err != nil {
+		log.Errorf("writing the webhook to the dead letter file %+v", err)
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ipe/config"
+	"ipe/connection"
+	"ipe/mocks"
+	"ipe/utils"
+)
+
+func newTestWebhookApp(url string) *Application {
+	a := NewApplication("Test", strconv.Itoa(id), "123", "123", false, false, true, true, url)
+	id++
+
+	return a
+}
+
+func TestWebhooks_delivered_in_background(t *testing.T) {
+	received := make(chan webHook, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hook webHook
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if err := json.Unmarshal(body, &hook); err != nil {
+			t.Errorf("decoding the webhook: %+v", err)
+		}
+
+		if signature := utils.HashMAC(body, []byte("123")); r.Header.Get("X-Pusher-Signature") != signature {
+			t.Errorf("X-Pusher-Signature == %s, wants %s", r.Header.Get("X-Pusher-Signature"), signature)
+		}
+
+		if r.Header.Get("X-Pusher-Key") != "123" {
+			t.Errorf("X-Pusher-Key == %s, wants %s", r.Header.Get("X-Pusher-Key"), "123")
+		}
+
+		received <- hook
+	}))
+	defer server.Close()
+
+	app := newTestWebhookApp(server.URL)
+	defer app.StopWebhooks()
+
+	app.TriggerChannelOccupiedHook(app.FindOrCreateChannelByChannelID("hello"))
+
+	select {
+	case hook := <-received:
+		if len(hook.Events) != 1 || hook.Events[0].Name != "channel_occupied" {
+			t.Errorf("hook.Events == %+v, wants a channel_occupied event", hook.Events)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the webhook was not delivered")
+	}
+}
+
+func TestWebhooks_queue_full_drops_events(t *testing.T) {
+	app := newTestWebhookApp("http://localhost")
+
+	// Fill the queue without starting the workers
+	app.webhooks.started = true
+
+	for i := 0; i < webhookQueueSize+5; i++ {
+		app.TriggerCacheMissHook(app.FindOrCreateChannelByChannelID("cache-hello"))
+	}
+
+	if depth := app.Stats.Get("WebhookQueueDepth").String(); depth != strconv.Itoa(webhookQueueSize) {
+		t.Errorf("WebhookQueueDepth == %s, wants %d", depth, webhookQueueSize)
+	}
+
+	if dropped := app.Stats.Get("TotalWebhooksDropped").String(); dropped != "5" {
+		t.Errorf("TotalWebhooksDropped == %s, wants %d", dropped, 5)
+	}
+}
+
+// waitStat waits the stat to be published, the webhooks are delivered in background
+func waitStat(app *Application, name string) string {
+	deadline := time.Now().Add(time.Second)
+
+	for app.Stats.Get(name) == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stat := app.Stats.Get(name); stat != nil {
+		return stat.String()
+	}
+
+	return ""
+}
+
+func noDelay(retry int) time.Duration {
+	return time.Millisecond
+}
+
+func TestWebhooks_failed_deliveries(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "error", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead-letter.log")
+	SetDeadLetterFile(deadLetter)
+	defer SetDeadLetterFile("")
+
+	app := newTestWebhookApp(server.URL)
+	app.WebhookMaxRetries = 2
+	app.webhooks.delay = noDelay
+
+	app.TriggerChannelVacatedHook(app.FindOrCreateChannelByChannelID("hello"))
+
+	if failed := waitStat(app, "TotalWebhooksFailed"); failed != "1" {
+		t.Errorf("TotalWebhooksFailed == %s, wants %d", failed, 1)
+	}
+
+	if total := atomic.LoadInt32(&requests); total != 3 {
+		t.Errorf("requests == %d, wants %d", total, 3)
+	}
+
+	data, err := ioutil.ReadFile(deadLetter)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var letter DeadLetter
+
+	if err := json.Unmarshal(data, &letter); err != nil {
+		t.Fatal(err)
+	}
+
+	if letter.AppID != app.AppID || letter.Attempts != 3 {
+		t.Errorf("letter == %+v, wants app_id %s and %d attempts", letter, app.AppID, 3)
+	}
+
+	app.StopWebhooks()
+	app.TriggerChannelVacatedHook(app.FindOrCreateChannelByChannelID("hello"))
+
+	if dropped := app.Stats.Get("TotalWebhooksDropped").String(); dropped != "1" {
+		t.Errorf("TotalWebhooksDropped == %s, wants %d", dropped, 1)
+	}
+}
+
+func TestWebhooks_retried_until_delivered(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			http.Error(w, "error", http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	app := newTestWebhookApp(server.URL)
+	app.webhooks.delay = noDelay
+	defer app.StopWebhooks()
+
+	app.TriggerChannelOccupiedHook(app.FindOrCreateChannelByChannelID("hello"))
+
+	if delivered := waitStat(app, "TotalWebhooksDelivered"); delivered != "1" {
+		t.Errorf("TotalWebhooksDelivered == %s, wants %d", delivered, 1)
+	}
+
+	if total := atomic.LoadInt32(&requests); total != 3 {
+		t.Errorf("requests == %d, wants %d", total, 3)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for retry := 1; retry < 100; retry++ {
+		if delay := backoff(retry); delay <= 0 || delay > webhookMaxRetryDelay {
+			t.Errorf("backoff(%d) == %s, wants between 0 and %s", retry, delay, webhookMaxRetryDelay)
+		}
+	}
+
+	if delay := backoff(1); delay > webhookRetryDelay {
+		t.Errorf("backoff(1) == %s, wants up to %s", delay, webhookRetryDelay)
+	}
+}
+
+func TestWebhooks_batched(t *testing.T) {
+	received := make(chan webHook, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hook webHook
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if err := json.Unmarshal(body, &hook); err != nil {
+			t.Errorf("decoding the webhook: %+v", err)
+		}
+
+		if signature := utils.HashMAC(body, []byte("123")); r.Header.Get("X-Pusher-Signature") != signature {
+			t.Errorf("X-Pusher-Signature == %s, wants %s", r.Header.Get("X-Pusher-Signature"), signature)
+		}
+
+		received <- hook
+	}))
+	defer server.Close()
+
+	app := newTestWebhookApp(server.URL)
+	app.WebhookBatchSize = 3
+	app.WebhookBatchWindowMs = 50
+	defer app.StopWebhooks()
+
+	// Queue all the events before starting a single worker, so the batches are predictable
+	app.webhooks.started = true
+
+	for i := 0; i < 5; i++ {
+		app.TriggerChannelOccupiedHook(app.FindOrCreateChannelByChannelID(strconv.Itoa(i)))
+	}
+
+	app.webhooks.wg.Add(1)
+	go app.webhooks.work()
+
+	for _, size := range []int{3, 2} {
+		select {
+		case hook := <-received:
+			if len(hook.Events) != size {
+				t.Errorf("len(hook.Events) == %d, wants %d", len(hook.Events), size)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the webhook was not delivered")
+		}
+	}
+
+	app.StopWebhooks()
+
+	if delivered := app.Stats.Get("TotalWebhooksDelivered").String(); delivered != "5" {
+		t.Errorf("TotalWebhooksDelivered == %s, wants %d", delivered, 5)
+	}
+}
+
+func TestWebhooks_targets(t *testing.T) {
+	all := make(chan webHook, 10)
+	presence := make(chan webHook, 10)
+
+	newServer := func(received chan webHook) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var hook webHook
+
+			if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+				t.Errorf("decoding the webhook: %+v", err)
+			}
+
+			if received == presence && r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("Authorization == %s, wants %s", r.Header.Get("Authorization"), "Bearer token")
+			}
+
+			if r.Header.Get("X-Pusher-Key") != "123" {
+				t.Errorf("X-Pusher-Key == %s, wants %s", r.Header.Get("X-Pusher-Key"), "123")
+			}
+
+			received <- hook
+		}))
+	}
+
+	allServer := newServer(all)
+	defer allServer.Close()
+
+	presenceServer := newServer(presence)
+	defer presenceServer.Close()
+
+	app := newTestWebhookApp(allServer.URL)
+	app.WebhookTargets = []config.WebhookTarget{
+		{
+			URL:             presenceServer.URL,
+			Events:          []string{"member_added", "member_removed"},
+			ChannelPrefixes: []string{"presence-room-"},
+			Headers:         map[string]string{"Authorization": "Bearer token", "X-Pusher-Key": "replaced"},
+		},
+	}
+	defer app.StopWebhooks()
+
+	conn := connection.New("1", mocks.MockSocket{})
+	app.Connect(conn)
+
+	for _, name := range []string{"presence-room-1", "presence-lobby"} {
+		if err := app.Subscribe(app.FindOrCreateChannelByChannelID(name), conn, `{"user_id":"1"}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := func(hooks chan webHook, total int) []string {
+		var names []string
+
+		for len(names) < total {
+			select {
+			case hook := <-hooks:
+				for _, event := range hook.Events {
+					names = append(names, event.Name+" "+event.Channel)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("received %v, wants %d events", names, total)
+			}
+		}
+
+		return names
+	}
+
+	// channel_occupied and member_added of both channels
+	if names := received(all, 4); len(names) != 4 {
+		t.Errorf("all received %v, wants %d events", names, 4)
+	}
+
+	if names := received(presence, 1); names[0] != "member_added presence-room-1" {
+		t.Errorf("presence received %v, wants %s", names, "member_added presence-room-1")
+	}
+
+	select {
+	case hook := <-presence:
+		t.Errorf("presence received %+v, wants nothing", hook)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhooks_unmatched_events(t *testing.T) {
+	received := make(chan webHook, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hook webHook
+
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			t.Errorf("decoding the webhook: %+v", err)
+		}
+
+		received <- hook
+	}))
+	defer server.Close()
+
+	app := newTestWebhookApp("")
+	app.WebhookTargets = []config.WebhookTarget{{URL: server.URL, ChannelPrefixes: []string{"presence-"}}}
+	defer app.StopWebhooks()
+
+	app.TriggerChannelOccupiedHook(app.FindOrCreateChannelByChannelID("hello"))
+
+	if unmatched := waitStat(app, "TotalWebhooksUnmatched"); unmatched != "1" {
+		t.Errorf("TotalWebhooksUnmatched == %s, wants %d", unmatched, 1)
+	}
+
+	select {
+	case hook := <-received:
+		t.Errorf("received %+v, wants nothing", hook)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	target := config.WebhookTarget{
+		URL:             "http://localhost",
+		Events:          []string{"client_event"},
+		ChannelPrefixes: []string{"private-", "presence-"},
+	}
+
+	testCases := []struct {
+		event  hookEvent
+		accept bool
+	}{
+		{hookEvent{Name: "client_event", Channel: "private-a"}, true},
+		{hookEvent{Name: "client_event", Channel: "presence-a"}, true},
+		{hookEvent{Name: "client_event", Channel: "a"}, false},
+		{hookEvent{Name: "channel_occupied", Channel: "private-a"}, false},
+	}
+
+	for _, tc := range testCases {
+		if accept := accepts(target, tc.event); accept != tc.accept {
+			t.Errorf("accepts(_, %+v) == %t, wants %t", tc.event, accept, tc.accept)
+		}
+	}
+
+	if !accepts(config.WebhookTarget{URL: "http://localhost"}, hookEvent{Name: "cache_miss", Channel: "cache-a"}) {
+		t.Errorf("accepts(_, cache_miss) == %t, wants %t", false, true)
+	}
+}
+
+func TestWebhooks_retries_do_not_block_the_workers(t *testing.T) {
+	var failed int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hook webHook
+
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			t.Errorf("decoding the webhook: %+v", err)
+		}
+
+		if hook.Events[0].Channel == "fail" {
+			atomic.AddInt32(&failed, 1)
+			http.Error(w, "error", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead-letter.log")
+	SetDeadLetterFile(deadLetter)
+	defer SetDeadLetterFile("")
+
+	app := newTestWebhookApp(server.URL)
+	app.WebhookBatchSize = 1
+	app.webhooks.delay = func(retry int) time.Duration {
+		return time.Hour
+	}
+
+	// More failures than workers, the retries must wait without holding them
+	for i := 0; i < webhookWorkers+1; i++ {
+		app.TriggerCacheMissHook(app.FindOrCreateChannelByChannelID("fail"))
+	}
+
+	app.TriggerChannelOccupiedHook(app.FindOrCreateChannelByChannelID("hello"))
+
+	if delivered := waitStat(app, "TotalWebhooksDelivered"); delivered != "1" {
+		t.Errorf("TotalWebhooksDelivered == %s, wants %d", delivered, 1)
+	}
+
+	// The pending retries are dead lettered when the dispatcher is stopped
+	app.StopWebhooks()
+
+	if failed := app.Stats.Get("TotalWebhooksFailed").String(); failed != strconv.Itoa(webhookWorkers+1) {
+		t.Errorf("TotalWebhooksFailed == %s, wants %d", failed, webhookWorkers+1)
+	}
+
+	if total := atomic.LoadInt32(&failed); total != webhookWorkers+1 {
+		t.Errorf("failed requests == %d, wants %d", total, webhookWorkers+1)
+	}
+
+	data, err := ioutil.ReadFile(deadLetter)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(data), "\n"); lines != webhookWorkers+1 {
+		t.Errorf("dead letters == %d, wants %d", lines, webhookWorkers+1)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"sync"
+
+	"ipe/channel"
+	"ipe/connection"
+)
+
+// Number of shards of the registries, the channels and connections are distributed by the hash of the id
+const shardCount = 32
+
+// FNV-1a constants, see hash/fnv
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// shardIndex returns the shard of the given id
+// it is the same FNV-1a hash of hash/fnv without allocations
+func shardIndex(id string) int {
+	hash := uint32(fnvOffset32)
+
+	for i := 0; i < len(id); i++ {
+		hash ^= uint32(id[i])
+		hash *= fnvPrime32
+	}
+
+	return int(hash % shardCount)
+}
+
+// channelType selects the channels of a listing
+type channelType int
+
+const (
+	allChannels channelType = iota
+	presenceChannels
+	privateChannels
+	publicChannels
+)
+
+// channelShard holds part of the channels of an Application
+type channelShard struct {
+	sync.RWMutex
+
+	channels map[string]*channel.Channel
+
+	// Indexes by type, so the listings do not scan all the channels
+	indexes map[channelType]map[string]*channel.Channel
+
+	// Number of subscriptions in progress by channel, these channels can not be removed
+	subscribing map[string]int
+}
+
+// typeOf returns the type of the channel, used to find its index
+func typeOf(c *channel.Channel) channelType {
+	switch {
+	case c.IsPresence():
+		return presenceChannels
+	case c.IsPrivate():
+		return privateChannels
+	default:
+		return publicChannels
+	}
+}
+
+// get the channel with the given id
+// the caller must hold the lock
+func (s *channelShard) get(id string) (*channel.Channel, bool) {
+	c, exists := s.channels[id]
+	return c, exists
+}
+
+// add the channel, replacing the channel with the same id
+// the caller must hold the lock
+func (s *channelShard) add(c *channel.Channel) {
+	s.channels[c.ID] = c
+	s.indexes[typeOf(c)][c.ID] = c
+}
+
+// remove the channel with the given id, returns false if it does not exist
+// the caller must hold the lock
+func (s *channelShard) remove(id string) bool {
+	c, exists := s.channels[id]
+
+	if !exists {
+		return false
+	}
+
+	delete(s.channels, id)
+	delete(s.indexes[typeOf(c)], id)
+
+	return true
+}
+
+// channelRegistry the channels of an Application sharded by id
+type channelRegistry struct {
+	shards [shardCount]*channelShard
+}
+
+func newChannelRegistry() *channelRegistry {
+	r := &channelRegistry{}
+
+	for i := range r.shards {
+		r.shards[i] = &channelShard{
+			channels: make(map[string]*channel.Channel),
+			indexes: map[channelType]map[string]*channel.Channel{
+				presenceChannels: make(map[string]*channel.Channel),
+				privateChannels:  make(map[string]*channel.Channel),
+				publicChannels:   make(map[string]*channel.Channel),
+			},
+			subscribing: make(map[string]int),
+		}
+	}
+
+	return r
+}
+
+// shard returns the shard of the given channel id
+func (r *channelRegistry) shard(id string) *channelShard {
+	return r.shards[shardIndex(id)]
+}
+
+// list returns the channels of the given type
+func (r *channelRegistry) list(t channelType) []*channel.Channel {
+	var channels []*channel.Channel
+
+	for _, s := range r.shards {
+		s.RLock()
+
+		source := s.channels
+
+		if t != allChannels {
+			source = s.indexes[t]
+		}
+
+		for _, c := range source {
+			channels = append(channels, c)
+		}
+
+		s.RUnlock()
+	}
+
+	return channels
+}
+
+// len returns the total of channels
+func (r *channelRegistry) len() int {
+	total := 0
+
+	for _, s := range r.shards {
+		s.RLock()
+		total += len(s.channels)
+		s.RUnlock()
+	}
+
+	return total
+}
+
+// connectionShard holds part of the connections of an Application
+type connectionShard struct {
+	sync.RWMutex
+
+	connections map[string]*connection.Connection
+}
+
+// connectionRegistry the connections of an Application sharded by socket id
+type connectionRegistry struct {
+	shards [shardCount]*connectionShard
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	r := &connectionRegistry{}
+
+	for i := range r.shards {
+		r.shards[i] = &connectionShard{connections: make(map[string]*connection.Connection)}
+	}
+
+	return r
+}
+
+// shard returns the shard of the given socket id
+func (r *connectionRegistry) shard(socketID string) *connectionShard {
+	return r.shards[shardIndex(socketID)]
+}
+
+// add the connection, replacing the connection with the same socket id
+func (r *connectionRegistry) add(conn *connection.Connection) {
+	s := r.shard(conn.SocketID)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.connections[conn.SocketID] = conn
+}
+
+// remove the connection, returns false if it does not exist
+func (r *connectionRegistry) remove(socketID string) bool {
+	s := r.shard(socketID)
+
+	s.Lock()
+	defer s.Unlock()
+
+	_, exists := s.connections[socketID]
+	delete(s.connections, socketID)
+
+	return exists
+}
+
+// get the connection with the given socket id
+func (r *connectionRegistry) get(socketID string) (*connection.Connection, bool) {
+	s := r.shard(socketID)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	conn, exists := s.connections[socketID]
+
+	return conn, exists
+}
+
+// list returns all the connections
+func (r *connectionRegistry) list() []*connection.Connection {
+	var connections []*connection.Connection
+
+	for _, s := range r.shards {
+		s.RLock()
+
+		for _, conn := range s.connections {
+			connections = append(connections, conn)
+		}
+
+		s.RUnlock()
+	}
+
+	return connections
+}
+
+// len returns the total of connections
+func (r *connectionRegistry) len() int {
+	total := 0
+
+	for _, s := range r.shards {
+		s.RLock()
+		total += len(s.connections)
+		s.RUnlock()
+	}
+
+	return total
+}
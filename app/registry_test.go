@@ -0,0 +1,149 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"ipe/channel"
+	"ipe/connection"
+	"ipe/mocks"
+)
+
+func TestShardIndex(t *testing.T) {
+	used := make(map[int]bool)
+
+	for i := 0; i < 1000; i++ {
+		index := shardIndex(fmt.Sprintf("channel-%d", i))
+
+		if index < 0 || index >= shardCount {
+			t.Fatalf("shardIndex(...) == %d, wants between 0 and %d", index, shardCount-1)
+		}
+
+		used[index] = true
+	}
+
+	if len(used) != shardCount {
+		t.Errorf("len(used) == %d, wants %d", len(used), shardCount)
+	}
+
+	if shardIndex("channel") != shardIndex("channel") {
+		t.Errorf("shardIndex(%s) is not stable", "channel")
+	}
+}
+
+func TestChannelRegistry_indexes(t *testing.T) {
+	r := newChannelRegistry()
+
+	for _, id := range []string{"a", "b", "private-c", "private-encrypted-d", "presence-e"} {
+		s := r.shard(id)
+		s.Lock()
+		s.add(channel.New(id))
+		s.Unlock()
+	}
+
+	testCases := []struct {
+		t     channelType
+		total int
+	}{
+		{allChannels, 5},
+		{publicChannels, 2},
+		{privateChannels, 2},
+		{presenceChannels, 1},
+	}
+
+	for _, tc := range testCases {
+		if total := len(r.list(tc.t)); total != tc.total {
+			t.Errorf("len(r.list(%d)) == %d, wants %d", tc.t, total, tc.total)
+		}
+	}
+
+	s := r.shard("private-c")
+	s.Lock()
+	s.remove("private-c")
+	s.Unlock()
+
+	if total := len(r.list(privateChannels)); total != 1 {
+		t.Errorf("len(r.list(privateChannels)) == %d, wants %d", total, 1)
+	}
+
+	if r.len() != 4 {
+		t.Errorf("r.len() == %d, wants %d", r.len(), 4)
+	}
+}
+
+// The parallel benchmarks should scale with the number of cores, eg: go test -bench Parallel -cpu 1,2,4,8
+
+func BenchmarkFindChannelByChannelID_Parallel(b *testing.B) {
+	app := newTestApp()
+
+	for i := 0; i < 1000; i++ {
+		app.FindOrCreateChannelByChannelID(fmt.Sprintf("channel-%d", i))
+	}
+
+	var n int64
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		id := fmt.Sprintf("channel-%d", atomic.AddInt64(&n, 1)%1000)
+
+		for pb.Next() {
+			if _, err := app.FindChannelByChannelID(id); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkConnectDisconnect_Parallel(b *testing.B) {
+	app := newTestApp()
+
+	var n int64
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		worker := atomic.AddInt64(&n, 1)
+		i := 0
+
+		for pb.Next() {
+			conn := connection.New(fmt.Sprintf("%d.%d", worker, i), mocks.MockSocket{})
+			app.Connect(conn)
+			app.Disconnect(conn.SocketID)
+			i++
+		}
+	})
+}
+
+func BenchmarkSubscribe_Parallel(b *testing.B) {
+	app := newTestApp()
+
+	var n int64
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		worker := atomic.AddInt64(&n, 1)
+		i := 0
+
+		for pb.Next() {
+			conn := connection.New(fmt.Sprintf("%d.%d", worker, i), mocks.MockSocket{})
+			c := app.FindOrCreateChannelByChannelID(fmt.Sprintf("channel-%d-%d", worker, i%100))
+
+			if err := app.Subscribe(c, conn, ""); err != nil {
+				b.Fatal(err)
+			}
+
+			if err := app.Unsubscribe(c, conn); err != nil {
+				b.Fatal(err)
+			}
+
+			i++
+		}
+	})
+}
@@ -9,12 +9,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 
 	log "github.com/golang/glog"
 
 	"ipe/channel"
+	"ipe/config"
 	"ipe/subscription"
 	"ipe/utils"
 )
@@ -70,6 +73,10 @@ func newMemberRemovedHook(channel *channel.Channel, s *subscription.Subscription
 	return hookEvent{Name: "member_removed", Channel: channel.ID, UserID: s.ID}
 }
 
+func newCacheMissHook(channel *channel.Channel) hookEvent {
+	return hookEvent{Name: "cache_miss", Channel: channel.ID}
+}
+
 func newClientHook(channel *channel.Channel, s *subscription.Subscription, event string, data interface{}) hookEvent {
 	return hookEvent{Name: "client_event", Channel: channel.ID, Event: event, Data: data, SocketID: s.Connection.SocketID}
 }
@@ -78,24 +85,14 @@ func newClientHook(channel *channel.Channel, s *subscription.Subscription, event
 // { "name": "channel_occupied", "channel": "test_channel" }
 func (a *Application) TriggerChannelOccupiedHook(c *channel.Channel) {
 	event := newChannelOcuppiedHook(c)
-	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
-	defer cancel()
-
-	if err := triggerHook(ctx, a, event); err != nil {
-		log.Errorf("triggering webhook %+v", err)
-	}
+	a.enqueueHook(event)
 }
 
 // TriggerChannelVacatedHook channel_vacated
 // { "name": "channel_vacated", "channel": "test_channel" }
 func (a *Application) TriggerChannelVacatedHook(c *channel.Channel) {
 	event := newChannelVacatedHook(c)
-	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
-	defer cancel()
-
-	if err := triggerHook(ctx, a, event); err != nil {
-		log.Errorf("triggering webhook %+v", err)
-	}
+	a.enqueueHook(event)
 }
 
 // TriggerClientEventHook client_events
@@ -114,12 +111,7 @@ func (a *Application) TriggerClientEventHook(c *channel.Channel, s *subscription
 		event.UserID = s.ID
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
-	defer cancel()
-
-	if err := triggerHook(ctx, a, event); err != nil {
-		log.Errorf("triggering webhook %+v", err)
-	}
+	a.enqueueHook(event)
 }
 
 // TriggerMemberAddedHook member_added
@@ -130,12 +122,7 @@ func (a *Application) TriggerClientEventHook(c *channel.Channel, s *subscription
 // }
 func (a *Application) TriggerMemberAddedHook(c *channel.Channel, s *subscription.Subscription) {
 	event := newMemberAddedHook(c, s)
-	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
-	defer cancel()
-
-	if err := triggerHook(ctx, a, event); err != nil {
-		log.Errorf("triggering webhook %+v", err)
-	}
+	a.enqueueHook(event)
 }
 
 // TriggerMemberRemovedHook member_removed
@@ -146,81 +133,253 @@ func (a *Application) TriggerMemberAddedHook(c *channel.Channel, s *subscription
 // }
 func (a *Application) TriggerMemberRemovedHook(c *channel.Channel, s *subscription.Subscription) {
 	event := newMemberRemovedHook(c, s)
-	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
-	defer cancel()
+	a.enqueueHook(event)
+}
 
-	if err := triggerHook(ctx, a, event); err != nil {
-		log.Errorf("triggering webhook %+v", err)
-	}
+// TriggerCacheMissHook cache_miss
+// { "name": "cache_miss", "channel": "cache-channel" }
+func (a *Application) TriggerCacheMissHook(c *channel.Channel) {
+	event := newCacheMissHook(c)
+	a.enqueueHook(event)
 }
 
-func triggerHook(ctx context.Context, a *Application, event hookEvent) error {
-	if !a.WebHooks {
-		log.Infof("webhook are not enabled for app: %s", a.Name)
-		return fmt.Errorf("webhooks are not enabled for app: %s", a.Name)
+// enqueueHook queues the event to be delivered in background
+// the event is dropped if the webhooks are disabled or if the queue is full
+func (a *Application) enqueueHook(event hookEvent) {
+	if enabled, _, _ := a.webhooksConfig(); !enabled {
+		log.V(1).Infof("webhooks are not enabled for app: %s", a.AppID)
+		return
+	}
+
+	if !a.webhooks.enqueue(event) {
+		a.Stats.Add("TotalWebhooksDropped", 1)
+		log.Errorf("dropping the %s webhook of app %s, the queue is full or the webhooks are stopped", event.Name, a.AppID)
 	}
+}
 
-	done := make(chan bool)
+// webhooksConfig returns the current webhook configuration of the Application
+func (a *Application) webhooksConfig() (enabled bool, key, secret string) {
+	a.RLock()
+	defer a.RUnlock()
 
-	go func() {
-		log.Infof("Triggering %s event", event.Name)
+	return a.WebHooks, a.Key, a.Secret
+}
 
-		hook := webHook{TimeMs: time.Now().Unix()}
+// webhookTargets returns the endpoints of the webhooks
+// the url of the Application is a target receiving all the events
+func (a *Application) webhookTargets() []config.WebhookTarget {
+	a.RLock()
+	defer a.RUnlock()
 
-		hook.Events = append(hook.Events, event)
+	var targets []config.WebhookTarget
 
-		var js []byte
-		var err error
+	if a.URLWebHook != "" {
+		targets = append(targets, config.WebhookTarget{URL: a.URLWebHook})
+	}
 
-		js, err = json.Marshal(hook)
+	return append(targets, copyTargets(a.WebhookTargets)...)
+}
 
-		if err != nil {
-			log.Errorf("Error decoding json: %+v", err)
-			return
+// webhookTarget returns the target with the given url, a target without filters nor headers if it is not configured
+func (a *Application) webhookTarget(url string) config.WebhookTarget {
+	for _, target := range a.webhookTargets() {
+		if target.URL == url {
+			return target
 		}
+	}
+
+	return config.WebhookTarget{URL: url}
+}
 
-		var req *http.Request
+// accepts returns true if the event must be sent to the target
+func accepts(target config.WebhookTarget, event hookEvent) bool {
+	return matchAny(target.Events, func(name string) bool {
+		return name == event.Name
+	}) && matchAny(target.ChannelPrefixes, func(prefix string) bool {
+		return strings.HasPrefix(event.Channel, prefix)
+	})
+}
 
-		req, err = http.NewRequest("POST", a.URLWebHook, bytes.NewReader(js))
+// matchAny returns true if the filters are empty or if one of them matches
+func matchAny(filters []string, match func(string) bool) bool {
+	if len(filters) == 0 {
+		return true
+	}
 
-		if err != nil {
-			log.Errorf("Error creating request: %+v", err)
-			return
+	for _, filter := range filters {
+		if match(filter) {
+			return true
 		}
+	}
+
+	return false
+}
 
-		req = req.WithContext(ctx)
+// filterHooks returns the events accepted by the target
+func filterHooks(target config.WebhookTarget, events []hookEvent) []hookEvent {
+	var accepted []hookEvent
 
-		req.Header.Set("User-Agent", "Ipe UA; (+https://github.com/dimiro1/ipe)")
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-Pusher-Key", a.Key)
-		req.Header.Set("X-Pusher-Signature", utils.HashMAC(js, []byte(a.Secret)))
+	for _, event := range events {
+		if accepts(target, event) {
+			accepted = append(accepted, event)
+		}
+	}
+
+	return accepted
+}
 
-		log.V(1).Infof("%+v", req.Header)
-		log.V(1).Infof("%+v", string(js))
+// countUnmatched returns the number of events not accepted by any of the targets
+func countUnmatched(targets []config.WebhookTarget, events []hookEvent) int64 {
+	var total int64
 
-		resp, err := http.DefaultClient.Do(req)
+	for _, event := range events {
+		accepted := false
 
-		// See: http://devs.cloudimmunity.com/gotchas-and-common-mistakes-in-go-golang/index.html#close_http_resp_body
-		if resp != nil {
-			defer func() {
-				if err := resp.Body.Close(); err != nil {
-					log.Errorf("error closing response body %+v", err)
-				}
-			}()
+		for _, target := range targets {
+			if accepts(target, event) {
+				accepted = true
+				break
+			}
 		}
 
-		if err != nil {
-			log.Errorf("error posting %s event: %+v", event.Name, err)
+		if !accepted {
+			total++
 		}
+	}
+
+	return total
+}
+
+// webhookBatchConfig returns the maximum number of events of a webhook and the time waiting for more events
+func (a *Application) webhookBatchConfig() (int, time.Duration) {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.WebhookBatchSize, time.Duration(a.WebhookBatchWindowMs) * time.Millisecond
+}
+
+// webhookMaxRetries returns the number of attempts after the first failed delivery of a webhook
+func (a *Application) webhookMaxRetries() int {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.WebhookMaxRetries
+}
+
+// StopWebhooks stops the delivery of the webhooks, used when the Application is removed
+func (a *Application) StopWebhooks() {
+	a.webhooks.stop()
+}
+
+// webhookQueueDepth returns the number of webhook events waiting to be delivered
+func (a *Application) webhookQueueDepth() interface{} {
+	return a.webhooks.depth()
+}
+
+// encodeHook returns the payload of the webhook with the given events
+func encodeHook(events ...hookEvent) ([]byte, error) {
+	hook := webHook{TimeMs: time.Now().Unix(), Events: events}
+
+	js, err := json.Marshal(hook)
+
+	if err != nil {
+		return nil, fmt.Errorf("encoding the webhook: %+v", err)
+	}
+
+	return js, nil
+}
+
+// postHook posts the payload to the webhook target of the Application
+// the payload is signed with the current secret, so it can be sent again after a secret rotation
+func postHook(ctx context.Context, a *Application, target config.WebhookTarget, payload []byte) error {
+	enabled, key, secret := a.webhooksConfig()
+
+	if !enabled {
+		return fmt.Errorf("webhooks are not enabled for app: %s", a.AppID)
+	}
+
+	req, err := http.NewRequest("POST", target.URL, bytes.NewReader(payload))
+
+	if err != nil {
+		return fmt.Errorf("creating the webhook request: %+v", err)
+	}
+
+	req = req.WithContext(ctx)
+
+	for name, value := range target.Headers {
+		req.Header.Set(name, value)
+	}
+
+	req.Header.Set("User-Agent", "Ipe UA; (+https://github.com/dimiro1/ipe)")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pusher-Key", key)
+	req.Header.Set("X-Pusher-Signature", utils.HashMAC(payload, []byte(secret)))
+
+	log.V(1).Infof("%+v", req.Header)
+	log.V(1).Infof("%+v", string(payload))
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("posting the webhook: %+v", err)
+	}
 
-		// Successfully terminated
-		done <- true
+	// See: http://devs.cloudimmunity.com/gotchas-and-common-mistakes-in-go-golang/index.html#close_http_resp_body
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("error closing response body %+v", err)
+		}
 	}()
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-done:
-		return nil
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("posting the webhook: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// webhookRetryDelay is the base of the exponential backoff between the delivery attempts
+const webhookRetryDelay = 500 * time.Millisecond
+
+// webhookMaxRetryDelay is the maximum delay between two delivery attempts
+const webhookMaxRetryDelay = 30 * time.Second
+
+// backoff returns the delay before the given retry, starting at 1
+// it is a random value up to the exponential delay (full jitter), so the retries of many webhooks do not align
+func backoff(retry int) time.Duration {
+	delay := webhookMaxRetryDelay
+
+	if retry < 16 {
+		if d := webhookRetryDelay << uint(retry-1); d < delay {
+			delay = d
+		}
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// attemptHook posts the payload once, the request is aborted after maxTimeout
+func attemptHook(a *Application, target config.WebhookTarget, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
+	defer cancel()
+
+	return postHook(ctx, a, target, payload)
+}
+
+// deliverHook posts the payload retrying with exponential backoff on network errors and non 2xx responses
+// it blocks until the webhook is delivered or all the attempts fail, returns the number of attempts and the last error
+func deliverHook(a *Application, target config.WebhookTarget, payload []byte, delay func(retry int) time.Duration) (int, error) {
+	maxRetries := a.webhookMaxRetries()
+
+	for attempt := 1; ; attempt++ {
+		err := attemptHook(a, target, payload)
+
+		if err == nil || attempt > maxRetries {
+			return attempt, err
+		}
+
+		log.Warningf("delivering webhook of app %s to %s, attempt %d failed: %+v", a.AppID, target.URL, attempt, err)
+
+		time.Sleep(delay(attempt))
 	}
 }
@@ -0,0 +1,134 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package channel
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"ipe/connection"
+	"ipe/events"
+	"ipe/subscription"
+)
+
+const benchmarkSubscribers = 1000
+
+var benchmarkEvent = events.Raw{
+	Event:   "my-event",
+	Channel: "bench",
+	Data:    []byte(`"{\"message\":\"hello world\",\"values\":[1,2,3,4,5,6,7,8,9,10],\"nested\":{\"a\":\"b\"}}"`),
+}
+
+// newBenchmarkSockets returns the server side of real websocket connections
+// the client side of each connection reads and discards every message
+func newBenchmarkSockets(b *testing.B, total int) []*websocket.Conn {
+	accepted := make(chan *websocket.Conn)
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			b.Error(err)
+			return
+		}
+
+		accepted <- conn
+	}))
+
+	var (
+		sockets []*websocket.Conn
+		clients []*websocket.Conn
+	)
+
+	for i := 0; i < total; i++ {
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		go func() {
+			for {
+				_, r, err := client.NextReader()
+
+				if err != nil {
+					return
+				}
+
+				if _, err := io.Copy(ioutil.Discard, r); err != nil {
+					return
+				}
+			}
+		}()
+
+		clients = append(clients, client)
+		sockets = append(sockets, <-accepted)
+	}
+
+	b.Cleanup(func() {
+		for i := range sockets {
+			sockets[i].Close()
+			clients[i].Close()
+		}
+
+		server.Close()
+	})
+
+	return sockets
+}
+
+func newBenchmarkChannel(b *testing.B) *Channel {
+	c := New("bench")
+
+	for i, socket := range newBenchmarkSockets(b, benchmarkSubscribers) {
+		id := strconv.Itoa(i)
+		c.subscriptions[id] = subscription.New(connection.New(id, socket), "")
+	}
+
+	return c
+}
+
+// BenchmarkPublish encodes the message once for all the subscribers
+func BenchmarkPublish(b *testing.B) {
+	c := newBenchmarkChannel(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := c.Publish(benchmarkEvent, ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPublish_per_subscriber_encoding decodes the data and encodes it for every subscriber
+func BenchmarkPublish_per_subscriber_encoding(b *testing.B) {
+	c := newBenchmarkChannel(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var v interface{}
+
+		if err := json.Unmarshal(benchmarkEvent.Data, &v); err != nil {
+			b.Fatal(err)
+		}
+
+		for _, subs := range c.Subscriptions() {
+			subs.Connection.Publish(events.NewResponse(benchmarkEvent.Event, benchmarkEvent.Channel, v))
+		}
+	}
+}
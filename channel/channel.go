@@ -11,6 +11,7 @@ import (
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/gorilla/websocket"
 
 	"ipe/connection"
 	"ipe/events"
@@ -18,6 +19,29 @@ import (
 	"ipe/utils"
 )
 
+// DefaultCacheTTL how long a cache channel remembers the last published event
+const DefaultCacheTTL = 30 * time.Minute
+
+// Errors returned when a subscription exceeds the presence limits
+var (
+	ErrOverCapacity     = errors.New("presence channel is over capacity")
+	ErrUserInfoTooLarge = errors.New("presence user_info is too large")
+	ErrUserIDTooLong    = errors.New("presence user_id is too long")
+)
+
+// PresenceLimits limits of a presence channel, zero means unlimited
+type PresenceLimits struct {
+	MaxMembers      int
+	MaxUserInfoSize int
+	MaxUserIDLength int
+}
+
+// PresenceLimitsFunc returns the current limits of the presence channels
+type PresenceLimitsFunc func() PresenceLimits
+
+// GracePeriodFunc returns how long a Channel waits before it is considered vacated
+type GracePeriodFunc func() time.Duration
+
 // Option constructor function for Channel
 type Option func(*Channel)
 
@@ -36,18 +60,34 @@ type Channel struct {
 
 	createdAt time.Time
 
+	cacheMutex    sync.Mutex
+	cachedEvent   *events.Raw
+	cachedMessage *websocket.PreparedMessage
+	cachedAt      time.Time
+	cacheTTL      time.Duration
+	cacheTimer    *time.Timer
+
 	memberAddedListeners     []ListenerFunc
 	memberRemovedListeners   []ListenerFunc
 	channelOccupiedListeners []ListenerFunc
 	channelVacatedListeners  []ListenerFunc
 	clientEventListeners     []ClientEventListenerFunc
+	cacheMissListeners       []ListenerFunc
+	cacheExpiredListeners    []ListenerFunc
+
+	presenceLimits PresenceLimitsFunc
+
+	vacateGracePeriod GracePeriodFunc
+	vacating          bool
+	vacateTimer       *time.Timer
+	vacateSeq         uint64
 }
 
 // New Create a new Channel
 func New(channelID string, options ...Option) *Channel {
 	log.Infof("Creating a new Channel: %s", channelID)
 
-	c := &Channel{ID: channelID, createdAt: time.Now(), subscriptions: make(map[string]*subscription.Subscription)}
+	c := &Channel{ID: channelID, createdAt: time.Now(), cacheTTL: DefaultCacheTTL, subscriptions: make(map[string]*subscription.Subscription)}
 
 	for _, option := range options {
 		option(c)
@@ -91,6 +131,53 @@ func WithClientEventListener(f ClientEventListenerFunc) func(*Channel) {
 	}
 }
 
+// WithCacheMissListener appends the given ListenerFunc into the cacheMissListeners list
+func WithCacheMissListener(f ListenerFunc) func(*Channel) {
+	return func(c *Channel) {
+		c.cacheMissListeners = append(c.cacheMissListeners, f)
+	}
+}
+
+// WithCacheExpiredListener appends the given ListenerFunc into the cacheExpiredListeners list
+// The listeners are called when the event remembered by a cache channel expires, without a subscription
+func WithCacheExpiredListener(f ListenerFunc) func(*Channel) {
+	return func(c *Channel) {
+		c.cacheExpiredListeners = append(c.cacheExpiredListeners, f)
+	}
+}
+
+// WithCacheTTL sets how long the cache channel remembers the last published event
+func WithCacheTTL(ttl time.Duration) func(*Channel) {
+	return func(c *Channel) {
+		if ttl > 0 {
+			c.cacheTTL = ttl
+		}
+	}
+}
+
+// WithPresenceLimits sets the function used to get the limits of the presence channel
+func WithPresenceLimits(f PresenceLimitsFunc) func(*Channel) {
+	return func(c *Channel) {
+		c.presenceLimits = f
+	}
+}
+
+// WithVacateGracePeriod sets the function used to get how long the Channel waits before it is considered vacated
+func WithVacateGracePeriod(f GracePeriodFunc) func(*Channel) {
+	return func(c *Channel) {
+		c.vacateGracePeriod = f
+	}
+}
+
+// limits returns the presence limits of the Channel
+func (c *Channel) limits() PresenceLimits {
+	if c.presenceLimits == nil {
+		return PresenceLimits{}
+	}
+
+	return c.presenceLimits()
+}
+
 // Subscriptions returns a slice of subscriptions
 func (c *Channel) Subscriptions() []*subscription.Subscription {
 	c.RLock()
@@ -130,6 +217,52 @@ func (c *Channel) IsPrivate() bool {
 	return utils.IsPrivateChannel(c.ID)
 }
 
+// IsPrivateEncrypted Check if the type of the Channel is private encrypted
+func (c *Channel) IsPrivateEncrypted() bool {
+	return utils.IsPrivateEncryptedChannel(c.ID)
+}
+
+// IsCache Check if the Channel is a cache channel
+func (c *Channel) IsCache() bool {
+	return utils.IsCacheChannel(c.ID)
+}
+
+// CachedEvent returns the last event published into a cache channel
+// returns false if there is no event or if it has expired
+func (c *Channel) CachedEvent() (events.Raw, bool) {
+	event, _, ok := c.cached()
+	return event, ok
+}
+
+// cached returns the last event published into a cache channel and its encoded message
+func (c *Channel) cached() (events.Raw, *websocket.PreparedMessage, bool) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if c.cachedEvent == nil || time.Since(c.cachedAt) >= c.cacheTTL {
+		return events.Raw{}, nil, false
+	}
+
+	return *c.cachedEvent, c.cachedMessage, true
+}
+
+// cacheExpired calls the cacheExpiredListeners, unless a newer event was published in the meantime
+func (c *Channel) cacheExpired() {
+	if c.HasCachedEvent() {
+		return
+	}
+
+	for _, hook := range c.cacheExpiredListeners {
+		hook(c, nil)
+	}
+}
+
+// HasCachedEvent Check if the cache channel remembers an event
+func (c *Channel) HasCachedEvent() bool {
+	_, ok := c.CachedEvent()
+	return ok
+}
+
 // TotalSubscriptions Get the total of subscribers
 func (c *Channel) TotalSubscriptions() int {
 	c.RLock()
@@ -143,6 +276,12 @@ func (c *Channel) TotalUsers() int {
 	c.RLock()
 	defer c.RUnlock()
 
+	return c.totalUsers()
+}
+
+// totalUsers returns the number of unique users
+// the caller must hold the lock
+func (c *Channel) totalUsers() int {
 	total := make(map[string]int)
 
 	for _, s := range c.subscriptions {
@@ -153,15 +292,28 @@ func (c *Channel) TotalUsers() int {
 }
 
 // Subscribe Add a new subscriber to the Channel
+//
+// In presence channels the members are identified by the user_id,
+// so the member_added event is only sent when the first connection of the user subscribes.
+// The subscription is refused with one of the presence errors if it exceeds the limits of the Channel.
 func (c *Channel) Subscribe(conn *connection.Connection, channelData string) error {
 	log.Infof("Subscribing %s to Channel %s", conn.SocketID, c.ID)
 
 	_subscription := subscription.New(conn, channelData)
-	c.Lock()
-	c.subscriptions[conn.SocketID] = _subscription
-	c.Unlock()
 
-	if c.IsPresence() {
+	// Whether the subscription occupied the Channel
+	var occupied bool
+
+	if !c.IsPresence() {
+		c.Lock()
+		c.subscriptions[conn.SocketID] = _subscription
+		occupied = c.occupy()
+		c.Unlock()
+
+		conn.AddChannel(c.ID)
+
+		conn.Publish(events.NewSubscriptionSucceeded(c.ID, "{}"))
+	} else {
 		// User Info Data
 		var info struct {
 			UserID   string          `json:"user_id"`
@@ -182,22 +334,45 @@ func (c *Channel) Subscribe(conn *connection.Connection, channelData string) err
 			return err
 		}
 
-		c.Lock()
-		// Update the Subscription
+		limits := c.limits()
+
+		switch {
+		case limits.MaxUserIDLength > 0 && len(info.UserID) > limits.MaxUserIDLength:
+			return ErrUserIDTooLong
+		case limits.MaxUserInfoSize > 0 && len(js) > limits.MaxUserInfoSize:
+			return ErrUserInfoTooLarge
+		}
+
 		_subscription.ID = info.UserID
 		_subscription.Data = string(js)
-		c.Unlock()
 
-		// Publish pusher_internal:member_added
-		c.PublishMemberAddedEvent(channelData, _subscription)
+		c.Lock()
+		firstJoin := c.totalUserSubscriptions(info.UserID) == 0
 
-		for _, hook := range c.memberAddedListeners {
-			hook(c, _subscription)
+		// The connections of users already present are always accepted
+		if firstJoin && limits.MaxMembers > 0 && c.totalUsers() >= limits.MaxMembers {
+			c.Unlock()
+			return ErrOverCapacity
 		}
 
+		c.subscriptions[conn.SocketID] = _subscription
+		occupied = c.occupy()
+
 		// pusher_internal:subscription_succeeded
 		data := make(map[string]events.SubscriptionSucceededPresenceData)
 		data["presence"] = events.NewSubscriptionSucceedPresenceData(c.subscriptions)
+		c.Unlock()
+
+		conn.AddChannel(c.ID)
+
+		if firstJoin {
+			// Publish pusher_internal:member_added
+			c.PublishMemberAddedEvent(channelData, _subscription)
+
+			for _, hook := range c.memberAddedListeners {
+				hook(c, _subscription)
+			}
+		}
 
 		js, err = json.Marshal(data)
 
@@ -207,11 +382,22 @@ func (c *Channel) Subscribe(conn *connection.Connection, channelData string) err
 		}
 
 		conn.Publish(events.NewSubscriptionSucceeded(c.ID, string(js)))
-	} else {
-		conn.Publish(events.NewSubscriptionSucceeded(c.ID, "{}"))
 	}
 
-	if c.TotalSubscriptions() == 1 {
+	if c.IsCache() {
+		// Replay the last event or let the client know there is nothing in the cache
+		if _, message, ok := c.cached(); ok {
+			conn.PublishPrepared(message)
+		} else {
+			conn.Publish(events.NewCacheMiss(c.ID))
+
+			for _, hook := range c.cacheMissListeners {
+				hook(c, _subscription)
+			}
+		}
+	}
+
+	if occupied {
 		for _, hook := range c.channelOccupiedListeners {
 			hook(c, _subscription)
 		}
@@ -220,6 +406,48 @@ func (c *Channel) Subscribe(conn *connection.Connection, channelData string) err
 	return nil
 }
 
+// occupy returns true if the new subscription occupied the Channel
+// A subscription during the vacate grace period cancels the vacate, the Channel was never considered vacated.
+// the caller must hold the lock
+func (c *Channel) occupy() bool {
+	if len(c.subscriptions) != 1 {
+		return false
+	}
+
+	if c.vacating {
+		c.vacating = false
+		c.vacateTimer.Stop()
+
+		log.Infof("Channel %s occupied again during the vacate grace period", c.ID)
+
+		return false
+	}
+
+	return true
+}
+
+// IsVacating returns true if the Channel is waiting the grace period before it is considered vacated
+func (c *Channel) IsVacating() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.vacating
+}
+
+// totalUserSubscriptions returns the number of connections of the user subscribed to the Channel
+// the caller must hold the lock
+func (c *Channel) totalUserSubscriptions(userID string) int {
+	total := 0
+
+	for _, s := range c.subscriptions {
+		if s.ID == userID {
+			total++
+		}
+	}
+
+	return total
+}
+
 // IsSubscribed check if the user is subscribed
 func (c *Channel) IsSubscribed(conn *connection.Connection) bool {
 	c.RLock()
@@ -229,8 +457,21 @@ func (c *Channel) IsSubscribed(conn *connection.Connection) bool {
 	return exists
 }
 
+// Subscription returns the subscription of the connection
+func (c *Channel) Subscription(conn *connection.Connection) (*subscription.Subscription, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if _subscription, exists := c.subscriptions[conn.SocketID]; exists {
+		return _subscription, nil
+	}
+
+	return nil, errors.New("subscription not found")
+}
+
 // Unsubscribe Remove the subscriber from the Channel
 // It destroy the Channel if the channels does not have any subscribers.
+// With a vacate grace period the channelVacatedListeners are only called if nobody subscribes until its end.
 func (c *Channel) Unsubscribe(conn *connection.Connection) error {
 	log.Infof("unsubscribe %s from Channel %s", conn.SocketID, c.ID)
 
@@ -244,9 +485,13 @@ func (c *Channel) Unsubscribe(conn *connection.Connection) error {
 
 	c.Lock()
 	delete(c.subscriptions, conn.SocketID)
+	lastLeave := c.totalUserSubscriptions(_subscription.ID) == 0
 	c.Unlock()
 
-	if c.IsPresence() {
+	conn.RemoveChannel(c.ID)
+
+	// The member is only removed when the last connection of the user leaves
+	if c.IsPresence() && lastLeave {
 		// Publish pusher_internal:member_removed
 		c.PublishMemberRemovedEvent(_subscription)
 
@@ -255,7 +500,30 @@ func (c *Channel) Unsubscribe(conn *connection.Connection) error {
 		}
 	}
 
-	if !c.IsOccupied() {
+	var gracePeriod time.Duration
+
+	if c.vacateGracePeriod != nil {
+		gracePeriod = c.vacateGracePeriod()
+	}
+
+	c.Lock()
+	vacated := len(c.subscriptions) == 0 && !c.vacating
+
+	if vacated && gracePeriod > 0 {
+		// The Channel is only vacated if nobody subscribes during the grace period
+		vacated = false
+
+		c.vacating = true
+		c.vacateSeq++
+
+		seq := c.vacateSeq
+		c.vacateTimer = time.AfterFunc(gracePeriod, func() {
+			c.vacate(seq, _subscription)
+		})
+	}
+	c.Unlock()
+
+	if vacated {
 		for _, hook := range c.channelVacatedListeners {
 			hook(c, _subscription)
 		}
@@ -264,6 +532,23 @@ func (c *Channel) Unsubscribe(conn *connection.Connection) error {
 	return nil
 }
 
+// vacate calls the channelVacatedListeners at the end of the grace period
+// unless it was cancelled by a new subscription
+func (c *Channel) vacate(seq uint64, _subscription *subscription.Subscription) {
+	c.Lock()
+	if !c.vacating || c.vacateSeq != seq {
+		c.Unlock()
+		return
+	}
+
+	c.vacating = false
+	c.Unlock()
+
+	for _, hook := range c.channelVacatedListeners {
+		hook(c, _subscription)
+	}
+}
+
 // PublishMemberAddedEvent Publish a MemberAddedEvent to all subscriptions
 func (c *Channel) PublishMemberAddedEvent(data string, subscription *subscription.Subscription) {
 	c.RLock()
@@ -290,29 +575,52 @@ func (c *Channel) PublishMemberRemovedEvent(subscription *subscription.Subscript
 
 // Publish messages to all Subscribers
 // skip the ignore connection
+//
+// The message is encoded only once and the same frame is written to every subscriber.
 func (c *Channel) Publish(event events.Raw, ignore string) error {
 	c.RLock()
 	defer c.RUnlock()
 
-	b, err := event.Data.MarshalJSON()
+	b, err := events.EncodeResponse(event)
 
 	if err != nil {
 		return err
 	}
 
-	var v interface{}
+	message, err := websocket.NewPreparedMessage(websocket.TextMessage, b)
 
-	if err := json.Unmarshal(b, &v); err != nil {
+	if err != nil {
 		return err
 	}
 
-	log.Infof("Publishing message %+v to Channel %s", v, c.ID)
+	log.Infof("Publishing message %s to Channel %s", event.Data, c.ID)
+
+	if c.IsCache() {
+		c.cacheMutex.Lock()
+		c.cachedEvent = &event
+		c.cachedMessage = message
+		c.cachedAt = time.Now()
+
+		// Nothing else looks at the channel when the event expires, the listeners may remove it
+		if c.cacheTimer != nil {
+			c.cacheTimer.Stop()
+		}
+
+		c.cacheTimer = time.AfterFunc(c.cacheTTL, c.cacheExpired)
+		c.cacheMutex.Unlock()
+	}
 
 	for _, subs := range c.subscriptions {
 		if subs.Connection.SocketID != ignore {
-			subs.Connection.Publish(events.NewResponse(event.Event, event.Channel, v))
+			subs.Connection.PublishPrepared(message)
 		} else {
-			if utils.IsClientEvent(event.Event) {
+			if utils.IsClientEvent(event.Event) && len(c.clientEventListeners) > 0 {
+				var v interface{}
+
+				if err := json.Unmarshal(event.Data, &v); err != nil {
+					return err
+				}
+
 				for _, hook := range c.clientEventListeners {
 					hook(c, subs, event.Event, v)
 				}
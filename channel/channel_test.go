@@ -6,9 +6,12 @@ package channel
 
 import (
 	"ipe/connection"
+	"ipe/events"
 	"ipe/mocks"
 	"ipe/subscription"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestIsOccupied(t *testing.T) {
@@ -92,12 +95,221 @@ func TestIsSubscribed(t *testing.T) {
 	conn := connection.New("ID", mocks.MockSocket{})
 
 	if c.IsSubscribed(conn) {
-		t.Errorf("c.IsSubscribed(%q) == %t, wants %t", conn, c.IsSubscribed(conn), false)
+		t.Errorf("c.IsSubscribed(%v) == %t, wants %t", conn, c.IsSubscribed(conn), false)
 	}
 
 	c.subscriptions["ID"] = subscription.New(conn, "")
 
 	if !c.IsSubscribed(conn) {
-		t.Errorf("c.IsSubscribed(%q) == %t, wants %t", conn, c.IsSubscribed(conn), true)
+		t.Errorf("c.IsSubscribed(%v) == %t, wants %t", conn, c.IsSubscribed(conn), true)
+	}
+}
+
+func TestCacheMiss(t *testing.T) {
+	misses := 0
+
+	c := New("cache-ID", WithCacheMissListener(func(c *Channel, s *subscription.Subscription) {
+		misses++
+	}))
+
+	if !c.IsCache() {
+		t.Errorf("c.IsCache() == %t, wants %t", c.IsCache(), true)
+	}
+
+	_ = c.Subscribe(connection.New("1", mocks.MockSocket{}), "")
+
+	if misses != 1 {
+		t.Errorf("misses == %d, wants %d", misses, 1)
+	}
+
+	if err := c.Publish(events.Raw{Event: "event", Channel: c.ID, Data: []byte(`"{}"`)}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c.Subscribe(connection.New("2", mocks.MockSocket{}), "")
+
+	if misses != 1 {
+		t.Errorf("misses == %d, wants %d", misses, 1)
+	}
+
+	event, ok := c.CachedEvent()
+
+	if !ok || event.Event != "event" || string(event.Data) != `"{}"` {
+		t.Errorf("c.CachedEvent() == %+v, %t, wants the last published event", event, ok)
+	}
+}
+
+func TestCachedEvent_not_cache_channel(t *testing.T) {
+	c := New("ID")
+
+	if err := c.Publish(events.Raw{Event: "event", Channel: c.ID, Data: []byte(`"{}"`)}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.HasCachedEvent() {
+		t.Errorf("c.HasCachedEvent() == %t, wants %t", c.HasCachedEvent(), false)
+	}
+}
+
+func TestPresenceMembers_deduplicated_by_user_id(t *testing.T) {
+	added, removed := 0, 0
+
+	c := New("presence-ID",
+		WithMemberAddedListener(func(c *Channel, s *subscription.Subscription) {
+			added++
+		}),
+		WithMemberRemovedListener(func(c *Channel, s *subscription.Subscription) {
+			removed++
+		}),
+	)
+
+	conn1 := connection.New("1", mocks.MockSocket{})
+	conn2 := connection.New("2", mocks.MockSocket{})
+
+	for _, conn := range []*connection.Connection{conn1, conn2} {
+		if err := c.Subscribe(conn, `{"user_id":"1","user_info":{}}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if added != 1 {
+		t.Errorf("added == %d, wants %d", added, 1)
+	}
+
+	if c.TotalUsers() != 1 {
+		t.Errorf("c.TotalUsers() == %d, wants %d", c.TotalUsers(), 1)
+	}
+
+	_ = c.Unsubscribe(conn1)
+
+	if removed != 0 {
+		t.Errorf("removed == %d, wants %d", removed, 0)
+	}
+
+	_ = c.Unsubscribe(conn2)
+
+	if removed != 1 {
+		t.Errorf("removed == %d, wants %d", removed, 1)
+	}
+}
+
+func TestSubscribe_invalid_presence_data(t *testing.T) {
+	c := New("presence-ID")
+
+	if err := c.Subscribe(connection.New("1", mocks.MockSocket{}), "invalid"); err == nil {
+		t.Errorf("c.Subscribe(...) == %v, wants an error", err)
+	}
+
+	if c.IsOccupied() {
+		t.Errorf("c.IsOccupied() == %t, wants %t", c.IsOccupied(), false)
+	}
+}
+
+func TestSubscribe_presence_limits(t *testing.T) {
+	c := New("presence-ID", WithPresenceLimits(func() PresenceLimits {
+		return PresenceLimits{MaxMembers: 1, MaxUserInfoSize: 10, MaxUserIDLength: 3}
+	}))
+
+	testCases := []struct {
+		socketID    string
+		channelData string
+		err         error
+	}{
+		{"1", `{"user_id":"1234","user_info":{}}`, ErrUserIDTooLong},
+		{"1", `{"user_id":"1","user_info":{"name":"Too large"}}`, ErrUserInfoTooLarge},
+		{"1", `{"user_id":"1","user_info":{}}`, nil},
+		{"2", `{"user_id":"2","user_info":{}}`, ErrOverCapacity},
+		{"3", `{"user_id":"1","user_info":{}}`, nil},
+	}
+
+	for _, tc := range testCases {
+		if err := c.Subscribe(connection.New(tc.socketID, mocks.MockSocket{}), tc.channelData); err != tc.err {
+			t.Errorf("c.Subscribe(%s, %s) == %v, wants %v", tc.socketID, tc.channelData, err, tc.err)
+		}
+	}
+
+	if c.TotalSubscriptions() != 2 {
+		t.Errorf("c.TotalSubscriptions() == %d, wants %d", c.TotalSubscriptions(), 2)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	c := New("presence-ID")
+	conn := connection.New("1", mocks.MockSocket{})
+
+	if _, err := c.Subscription(conn); err == nil {
+		t.Errorf("c.Subscription(%v) == %v, wants an error", conn, err)
+	}
+
+	if err := c.Subscribe(conn, `{"user_id":"42","user_info":{}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.Subscription(conn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ID != "42" {
+		t.Errorf("s.ID == %s, wants %s", s.ID, "42")
+	}
+}
+
+func TestVacateGracePeriod(t *testing.T) {
+	var mutex sync.Mutex
+	occupied, vacated := 0, 0
+
+	c := New("ID",
+		WithChannelOccupiedListener(func(c *Channel, s *subscription.Subscription) {
+			mutex.Lock()
+			occupied++
+			mutex.Unlock()
+		}),
+		WithChannelVacatedListener(func(c *Channel, s *subscription.Subscription) {
+			mutex.Lock()
+			vacated++
+			mutex.Unlock()
+		}),
+		WithVacateGracePeriod(func() time.Duration {
+			return 50 * time.Millisecond
+		}),
+	)
+
+	conn := connection.New("1", mocks.MockSocket{})
+
+	_ = c.Subscribe(conn, "")
+	_ = c.Unsubscribe(conn)
+
+	if !c.IsVacating() {
+		t.Errorf("c.IsVacating() == %t, wants %t", false, true)
+	}
+
+	// Resubscribing during the grace period cancels the vacate and the occupied
+	_ = c.Subscribe(conn, "")
+
+	if c.IsVacating() {
+		t.Errorf("c.IsVacating() == %t, wants %t", true, false)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	mutex.Lock()
+	if occupied != 1 || vacated != 0 {
+		t.Errorf("occupied, vacated == %d, %d, wants %d, %d", occupied, vacated, 1, 0)
+	}
+	mutex.Unlock()
+
+	_ = c.Unsubscribe(conn)
+	time.Sleep(100 * time.Millisecond)
+
+	mutex.Lock()
+	if occupied != 1 || vacated != 1 {
+		t.Errorf("occupied, vacated == %d, %d, wants %d, %d", occupied, vacated, 1, 1)
+	}
+	mutex.Unlock()
+
+	if c.IsVacating() {
+		t.Errorf("c.IsVacating() == %t, wants %t", true, false)
 	}
 }
@@ -22,8 +22,14 @@ var (
 // Main function, initialize the system
 func main() {
 	var filename = flag.String("config", "config.yml", "Config file location")
+	var replayWebhooks = flag.Bool("replay-webhooks", false, "Deliver again the webhooks of the dead letter file and exit")
 	flag.Parse()
 
+	if *replayWebhooks {
+		ipe.ReplayWebhooks(*filename)
+		return
+	}
+
 	printBanner()
 
 	ipe.Start(*filename)
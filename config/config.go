@@ -4,12 +4,37 @@
 
 package config
 
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
 // File config file
 type File struct {
-	Host      string        `yaml:"host"` // The host, eg: :8080 will start on 0.0.0.0:8080
-	SSL       SSL           `yaml:"ssl"`
-	Profiling bool          `yaml:"profiling"`
-	Apps      []Application `yaml:"apps"`
+	Host                string        `yaml:"host"` // The host, eg: :8080 will start on 0.0.0.0:8080
+	SSL                 SSL           `yaml:"ssl"`
+	Admin               Admin         `yaml:"admin"`
+	Profiling           bool          `yaml:"profiling"`
+	AuthTimestampWindow int           `yaml:"auth_timestamp_window"` // Maximum skew of the REST auth_timestamp in seconds, 600 if not set
+	WebhooksDeadLetter  string        `yaml:"webhooks_dead_letter"`  // File where the webhooks that could not be delivered are appended
+	Apps                []Application `yaml:"apps"`
+}
+
+// AuthTimestampWindowDuration the auth_timestamp_window as a duration
+func (f File) AuthTimestampWindowDuration() time.Duration {
+	return time.Duration(f.AuthTimestampWindow) * time.Second
+}
+
+// Validate checks the server options
+func (f File) Validate() error {
+	if f.AuthTimestampWindow < 0 {
+		return errors.New("auth_timestamp_window must be a positive number of seconds")
+	}
+
+	return f.Admin.Validate()
 }
 
 // SSL related configuration options
@@ -20,20 +45,192 @@ type SSL struct {
 	CertFile string `yaml:"cert_file"`
 }
 
+// Admin related configuration options
+// The admin API runs in its own listener and is signed with its own credentials
+type Admin struct {
+	Enabled bool   `yaml:"enabled"`
+	Host    string `yaml:"host"`
+	Key     string `yaml:"key"`
+	Secret  string `yaml:"secret"`
+}
+
+// Validate checks the admin options
+// The admin API can not be enabled without credentials, anyone could manage the apps otherwise
+func (a Admin) Validate() error {
+	if !a.Enabled {
+		return nil
+	}
+
+	if strings.TrimSpace(a.Key) == "" || strings.TrimSpace(a.Secret) == "" {
+		return errors.New("the admin key and secret are required when the admin API is enabled")
+	}
+
+	return nil
+}
+
 // Application related configuration options
 type Application struct {
-	Name       string   `yaml:"name"`
-	AppID      string   `yaml:"app_id"`
-	Key        string   `yaml:"key"`
-	Secret     string   `yaml:"secret"`
-	OnlySSL    bool     `yaml:"only_ssl"`
-	Enabled    bool     `yaml:"enabled"`
-	UserEvents bool     `yaml:"user_events"`
-	WebHooks   Webhooks `yaml:"webhooks"`
+	Name       string   `yaml:"name" json:"name"`
+	AppID      string   `yaml:"app_id" json:"app_id"`
+	Key        string   `yaml:"key" json:"key"`
+	Secret     string   `yaml:"secret" json:"secret"`
+	OnlySSL    bool     `yaml:"only_ssl" json:"only_ssl"`
+	Enabled    bool     `yaml:"enabled" json:"enabled"`
+	UserEvents bool     `yaml:"user_events" json:"user_events"`
+	WebHooks   Webhooks `yaml:"webhooks" json:"webhooks"`
+
+	// Base64 encoded 32 bytes key, required to use private-encrypted channels
+	EncryptionMasterKey string `yaml:"encryption_master_key" json:"encryption_master_key,omitempty"`
+
+	// Seconds of inactivity before the server pings the connection, 120 if not set
+	ActivityTimeout int `yaml:"activity_timeout" json:"activity_timeout,omitempty"`
+
+	// Origins allowed to open websocket connections, eg: https://example.com or *.example.com
+	// All origins are allowed if empty
+	AllowedOrigins []string `yaml:"allowed_origins" json:"allowed_origins,omitempty"`
+
+	// Limits of the presence channels, the Pusher defaults are used if not set
+	PresenceMaxMembers      int `yaml:"presence_max_members" json:"presence_max_members,omitempty"`
+	PresenceMaxUserInfoSize int `yaml:"presence_max_user_info_size" json:"presence_max_user_info_size,omitempty"`
+	PresenceMaxUserIDLength int `yaml:"presence_max_user_id_length" json:"presence_max_user_id_length,omitempty"`
+
+	// Milliseconds a channel waits before it is vacated, a subscription in the meantime cancels the channel_vacated webhook
+	// The channel is vacated immediately if not set
+	VacateGracePeriodMs int `yaml:"vacate_grace_period_ms" json:"vacate_grace_period_ms,omitempty"`
+
+	// Maximum number of client events per second of each connection, 10 if not set
+	ClientEventsPerSecond int `yaml:"client_events_per_second" json:"client_events_per_second,omitempty"`
+}
+
+// Validate checks the application options
+func (a Application) Validate() error {
+	if a.EncryptionMasterKey != "" {
+		key, err := base64.StdEncoding.DecodeString(a.EncryptionMasterKey)
+
+		if err != nil || len(key) != 32 {
+			return errors.New("encryption_master_key must be a base64 encoded 32 bytes key")
+		}
+	}
+
+	if a.ActivityTimeout < 0 {
+		return errors.New("activity_timeout must be a positive number of seconds")
+	}
+
+	// The url already receives all the events, a target with the same url would receive them twice
+	urls := make(map[string]bool)
+
+	if url := strings.TrimSpace(a.WebHooks.URL); url != "" {
+		urls[url] = true
+	}
+
+	for _, target := range a.WebHooks.Targets {
+		if err := target.Validate(); err != nil {
+			return err
+		}
+
+		url := strings.TrimSpace(target.URL)
+
+		if urls[url] {
+			return fmt.Errorf("webhook target %s is repeated, each url can be used once", url)
+		}
+
+		urls[url] = true
+	}
+
+	if a.VacateGracePeriodMs < 0 {
+		return errors.New("vacate_grace_period_ms must be a positive number of milliseconds")
+	}
+
+	if a.ClientEventsPerSecond < 0 {
+		return errors.New("client_events_per_second must be a positive number")
+	}
+
+	if (a.WebHooks.MaxRetries != nil && *a.WebHooks.MaxRetries < 0) || a.WebHooks.BatchSize < 0 || a.WebHooks.BatchWindowMs < 0 {
+		return errors.New("webhooks max_retries, batch_size and batch_window_ms must be positive numbers")
+	}
+
+	if a.PresenceMaxMembers < 0 || a.PresenceMaxUserInfoSize < 0 || a.PresenceMaxUserIDLength < 0 {
+		return errors.New("presence limits must be positive numbers")
+	}
+
+	for _, origin := range a.AllowedOrigins {
+		if strings.TrimSpace(origin) == "" {
+			return errors.New("allowed_origins can not contain empty origins")
+		}
+	}
+
+	return nil
 }
 
 // Webhooks related configuration options
 type Webhooks struct {
-	Enabled bool   `yaml:"enabled"`
-	URL     string `yaml:"url"`
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	URL     string `yaml:"url" json:"url"`
+
+	// Attempts after the first failed delivery, 3 if not set, 0 disables the retries
+	MaxRetries *int `yaml:"max_retries" json:"max_retries,omitempty"`
+
+	// Maximum number of events sent in a single request, 50 if not set
+	BatchSize int `yaml:"batch_size" json:"batch_size,omitempty"`
+
+	// Milliseconds waiting for more events before sending a request, the events already queued are sent immediately if not set
+	BatchWindowMs int `yaml:"batch_window_ms" json:"batch_window_ms,omitempty"`
+
+	// Other endpoints receiving the webhooks, the URL receives all the events
+	Targets []WebhookTarget `yaml:"targets" json:"targets,omitempty"`
+}
+
+// WebhookEvents the names of the webhook events
+var WebhookEvents = []string{
+	"channel_occupied",
+	"channel_vacated",
+	"member_added",
+	"member_removed",
+	"client_event",
+	"cache_miss",
+}
+
+// WebhookTarget an endpoint receiving some of the webhook events
+type WebhookTarget struct {
+	URL string `yaml:"url" json:"url"`
+
+	// Names of the events sent to the endpoint, all if empty
+	Events []string `yaml:"events" json:"events,omitempty"`
+
+	// Only the events of the channels starting with one of the prefixes are sent, all if empty
+	ChannelPrefixes []string `yaml:"channel_prefixes" json:"channel_prefixes,omitempty"`
+
+	// Extra headers of the requests, they can not replace the X-Pusher-Key and X-Pusher-Signature headers
+	Headers map[string]string `yaml:"headers" json:"headers,omitempty"`
+}
+
+// Validate checks the target options
+func (t WebhookTarget) Validate() error {
+	if strings.TrimSpace(t.URL) == "" {
+		return errors.New("webhook targets must have an url")
+	}
+
+	for _, event := range t.Events {
+		if !isWebhookEvent(event) {
+			return fmt.Errorf("unknown webhook event %q, must be one of %s", event, strings.Join(WebhookEvents, ", "))
+		}
+	}
+
+	for name := range t.Headers {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("webhook target headers can not have empty names")
+		}
+	}
+
+	return nil
+}
+
+func isWebhookEvent(name string) bool {
+	for _, event := range WebhookEvents {
+		if event == name {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,55 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package connection
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket A simple token bucket rate limiter
+//
+// The bucket starts full, holds at most burst tokens and is refilled with rate tokens per second.
+type TokenBucket struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket Create a new full TokenBucket
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow takes one token from the bucket, returns false if the bucket is empty
+func (b *TokenBucket) Allow() bool {
+	return b.allowAt(time.Now())
+}
+
+func (b *TokenBucket) allowAt(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
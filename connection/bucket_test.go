@@ -0,0 +1,47 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package connection
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10, 10)
+	now := b.last
+
+	for i := 0; i < 10; i++ {
+		if !b.allowAt(now) {
+			t.Fatalf("b.allowAt(now) == %t, wants %t after %d tokens", false, true, i)
+		}
+	}
+
+	if b.allowAt(now) {
+		t.Errorf("b.allowAt(now) == %t, wants %t", true, false)
+	}
+
+	// One token every 100ms
+	now = now.Add(100 * time.Millisecond)
+
+	if !b.allowAt(now) {
+		t.Errorf("b.allowAt(now) == %t, wants %t", false, true)
+	}
+
+	if b.allowAt(now) {
+		t.Errorf("b.allowAt(now) == %t, wants %t", true, false)
+	}
+
+	// Never more than the burst
+	now = now.Add(time.Hour)
+
+	for i := 0; i < 10; i++ {
+		b.allowAt(now)
+	}
+
+	if b.allowAt(now) {
+		t.Errorf("b.allowAt(now) == %t, wants %t", true, false)
+	}
+}
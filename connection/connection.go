@@ -6,38 +6,262 @@ package connection
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write the close frame
+	closeWriteWait = time.Second
+
+	// Time the client has to reply the close handshake
+	closeGracePeriod = 5 * time.Second
+
+	// Maximum size of the reason of a close frame
+	maxCloseReasonSize = 123
+
+	// Time allowed to write a message to the client
+	writeWait = 10 * time.Second
 )
 
 // Socket interface to write to the client
 type Socket interface {
 	WriteJSON(interface{}) error
+	WritePreparedMessage(pm *websocket.PreparedMessage) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
 }
 
 // Connection An user connection
 type Connection struct {
+	// Unix time in nanoseconds of the last message received from the client
+	// must be the first field to be 64-bit aligned for the atomic operations
+	lastActivity int64
+
 	sync.Mutex
 
 	SocketID  string
 	Socket    Socket
 	CreatedAt time.Time
+
+	userMutex sync.RWMutex
+	userID    string
+
+	// The ids of the channels the connection is subscribed to
+	channelsMutex sync.Mutex
+	channels      map[string]struct{}
+
+	clientEvents         *TokenBucket
+	clientEventsRejected int32
+
+	closing bool
+
+	// The write queue, nil if the writes are synchronous
+	queue      chan outbound
+	overflowed bool
+	onOverflow func(*Connection)
+	done       chan struct{}
+	stopOnce   sync.Once
+}
+
+// Option constructor function for Connection
+type Option func(*Connection)
+
+// WithClientEventsLimit limits the number of client events per second the connection can send
+// zero means unlimited
+func WithClientEventsLimit(perSecond int) Option {
+	return func(conn *Connection) {
+		if perSecond > 0 {
+			conn.clientEvents = NewTokenBucket(float64(perSecond), perSecond)
+		}
+	}
 }
 
 // New Create a new Subscriber
-func New(socketID string, s Socket) *Connection {
+func New(socketID string, s Socket, options ...Option) *Connection {
 	log.Infof("Creating a new Subscriber %+v", socketID)
 
-	return &Connection{SocketID: socketID, Socket: s, CreatedAt: time.Now()}
+	now := time.Now()
+
+	conn := &Connection{
+		SocketID:     socketID,
+		Socket:       s,
+		CreatedAt:    now,
+		lastActivity: now.UnixNano(),
+		channels:     make(map[string]struct{}),
+	}
+
+	for _, option := range options {
+		option(conn)
+	}
+
+	if conn.queue != nil {
+		go conn.writeLoop()
+	}
+
+	return conn
+}
+
+// AllowClientEvent Verify if the connection can send one more client event
+// returns the number of consecutive rejected client events, zero if the event is allowed
+func (conn *Connection) AllowClientEvent() (bool, int) {
+	if conn.clientEvents == nil || conn.clientEvents.Allow() {
+		atomic.StoreInt32(&conn.clientEventsRejected, 0)
+		return true, 0
+	}
+
+	return false, int(atomic.AddInt32(&conn.clientEventsRejected, 1))
+}
+
+// Touch records that the client has just sent a message
+func (conn *Connection) Touch() {
+	atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+}
+
+// LastActivity returns the time of the last message sent by the client
+func (conn *Connection) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&conn.lastActivity))
+}
+
+// AddChannel records that the connection is subscribed to the channel
+func (conn *Connection) AddChannel(channelID string) {
+	conn.channelsMutex.Lock()
+	defer conn.channelsMutex.Unlock()
+
+	conn.channels[channelID] = struct{}{}
+}
+
+// RemoveChannel records that the connection is not subscribed to the channel anymore
+func (conn *Connection) RemoveChannel(channelID string) {
+	conn.channelsMutex.Lock()
+	defer conn.channelsMutex.Unlock()
+
+	delete(conn.channels, channelID)
+}
+
+// Channels returns the ids of the channels the connection is subscribed to
+func (conn *Connection) Channels() []string {
+	conn.channelsMutex.Lock()
+	defer conn.channelsMutex.Unlock()
+
+	channels := make([]string, 0, len(conn.channels))
+
+	for channelID := range conn.channels {
+		channels = append(channels, channelID)
+	}
+
+	return channels
+}
+
+// SignIn associates the connection with the given user
+func (conn *Connection) SignIn(userID string) {
+	conn.userMutex.Lock()
+	defer conn.userMutex.Unlock()
+
+	conn.userID = userID
+}
+
+// UserID returns the id of the signed in user, or an empty string
+func (conn *Connection) UserID() string {
+	conn.userMutex.RLock()
+	defer conn.userMutex.RUnlock()
+
+	return conn.userID
 }
 
 // Publish the message to websocket attached to this client
+// Nothing is sent after the close frame or after the write queue overflows
 func (conn *Connection) Publish(m interface{}) {
+	conn.send(outbound{message: m})
+}
+
+// PublishPrepared publishes a message that was encoded once for all the clients
+func (conn *Connection) PublishPrepared(pm *websocket.PreparedMessage) {
+	conn.send(outbound{prepared: pm})
+}
+
+func (conn *Connection) send(o outbound) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.closing || conn.overflowed {
+		return
+	}
+
+	if conn.queue == nil {
+		if err := conn.write(o); err != nil {
+			log.Errorf("error writing into Socket, %+v", err)
+		}
+
+		return
+	}
+
+	if !conn.enqueue(o) {
+		log.Infof("the write queue of socket %s is full, slow consumer", conn.SocketID)
+		conn.overflowed = true
+
+		// The callback usually disconnects the connection,
+		// it must not run while the publisher holds the channel locks
+		if conn.onOverflow != nil {
+			go conn.onOverflow(conn)
+		}
+	}
+}
+
+// Close the websocket attached to this client, the writer goroutine is stopped
+func (conn *Connection) Close() {
+	conn.Stop()
+
 	conn.Lock()
 	defer conn.Unlock()
 
-	if err := conn.Socket.WriteJSON(m); err != nil {
-		log.Errorf("error writing json into Socket, %+v", err)
+	if err := conn.Socket.Close(); err != nil {
+		log.Errorf("error closing Socket, %+v", err)
+	}
+}
+
+// CloseWithError starts the close handshake sending a close frame with the given code and reason
+//
+// The client has a grace period to reply the close frame, after that the reads fail
+// and the websocket is dropped by the read loop.
+func (conn *Connection) CloseWithError(code int, reason string) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.closing {
+		return
+	}
+
+	conn.closing = true
+
+	if len(reason) > maxCloseReasonSize {
+		reason = reason[:maxCloseReasonSize]
 	}
+
+	now := time.Now()
+	frame := websocket.FormatCloseMessage(code, reason)
+
+	// The close frame goes after the queued messages, unless the queue is full
+	if conn.queue == nil || !conn.enqueue(outbound{closeFrame: frame}) {
+		if err := conn.Socket.WriteControl(websocket.CloseMessage, frame, now.Add(closeWriteWait)); err != nil {
+			log.Errorf("error writing the close frame into Socket, %+v", err)
+		}
+	}
+
+	if err := conn.Socket.SetReadDeadline(now.Add(closeGracePeriod)); err != nil {
+		log.Errorf("error setting the read deadline of Socket, %+v", err)
+	}
+}
+
+// IsClosing Verify if the close handshake was started
+func (conn *Connection) IsClosing() bool {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.closing
 }
@@ -7,6 +7,9 @@ package connection
 import (
 	"ipe/mocks"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestNewConnection(t *testing.T) {
@@ -27,3 +30,115 @@ func TestNewConnection(t *testing.T) {
 		t.Errorf("c.createdAt.IsZero() == %t, wants %t", c.CreatedAt.IsZero(), false)
 	}
 }
+
+func TestSignIn(t *testing.T) {
+	c := New("socketID", mocks.MockSocket{})
+
+	if c.UserID() != "" {
+		t.Errorf("c.UserID() == %s, wants %s", c.UserID(), "")
+	}
+
+	c.SignIn("1")
+
+	if c.UserID() != "1" {
+		t.Errorf("c.UserID() == %s, wants %s", c.UserID(), "1")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	c := New("socketID", mocks.MockSocket{})
+
+	before := c.LastActivity()
+
+	if before.IsZero() {
+		t.Errorf("c.LastActivity().IsZero() == %t, wants %t", before.IsZero(), false)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	c.Touch()
+
+	if !c.LastActivity().After(before) {
+		t.Errorf("c.LastActivity().After(before) == %t, wants %t", false, true)
+	}
+}
+
+func TestAllowClientEvent(t *testing.T) {
+	c := New("socketID", mocks.MockSocket{}, WithClientEventsLimit(1))
+
+	if allowed, rejected := c.AllowClientEvent(); !allowed || rejected != 0 {
+		t.Errorf("c.AllowClientEvent() == %t, %d, wants %t, %d", allowed, rejected, true, 0)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if allowed, rejected := c.AllowClientEvent(); allowed || rejected != i {
+			t.Errorf("c.AllowClientEvent() == %t, %d, wants %t, %d", allowed, rejected, false, i)
+		}
+	}
+
+	unlimited := New("socketID", mocks.MockSocket{})
+
+	for i := 0; i < 100; i++ {
+		if allowed, _ := unlimited.AllowClientEvent(); !allowed {
+			t.Fatalf("unlimited.AllowClientEvent() == %t, wants %t", allowed, true)
+		}
+	}
+}
+
+type closeRecorder struct {
+	mocks.MockSocket
+
+	written  int
+	closeMsg []byte
+}
+
+func (s *closeRecorder) WriteJSON(i interface{}) error {
+	s.written++
+	return nil
+}
+
+func (s *closeRecorder) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	s.closeMsg = data
+	return nil
+}
+
+func TestCloseWithError(t *testing.T) {
+	s := &closeRecorder{}
+	c := New("socketID", s)
+
+	if c.IsClosing() {
+		t.Errorf("c.IsClosing() == %t, wants %t", true, false)
+	}
+
+	c.CloseWithError(4001, "Application does not exist")
+
+	if !c.IsClosing() {
+		t.Errorf("c.IsClosing() == %t, wants %t", false, true)
+	}
+
+	expected := websocket.FormatCloseMessage(4001, "Application does not exist")
+
+	if string(s.closeMsg) != string(expected) {
+		t.Errorf("s.closeMsg == %v, wants %v", s.closeMsg, expected)
+	}
+
+	c.Publish("after close")
+
+	if s.written != 0 {
+		t.Errorf("s.written == %d, wants %d", s.written, 0)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	c := New("socketID", mocks.MockSocket{})
+
+	c.AddChannel("a")
+	c.AddChannel("b")
+	c.AddChannel("a")
+	c.RemoveChannel("b")
+
+	channels := c.Channels()
+
+	if len(channels) != 1 || channels[0] != "a" {
+		t.Errorf("c.Channels() == %v, wants %v", channels, []string{"a"})
+	}
+}
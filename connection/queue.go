@@ -0,0 +1,102 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package connection
+
+import (
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// outbound is an item of the write queue, a JSON message, a prepared message or a close frame
+type outbound struct {
+	message    interface{}
+	prepared   *websocket.PreparedMessage
+	closeFrame []byte
+}
+
+// WithWriteQueue makes the writes asynchronous
+//
+// The messages are queued and written by a writer goroutine using write deadlines,
+// so a slow client does not block the publishers.
+// When the queue is full the messages are dropped and onOverflow is called once.
+func WithWriteQueue(size int, onOverflow func(*Connection)) Option {
+	return func(conn *Connection) {
+		conn.queue = make(chan outbound, size)
+		conn.onOverflow = onOverflow
+		conn.done = make(chan struct{})
+	}
+}
+
+// QueueLength returns the number of messages waiting to be written
+func (conn *Connection) QueueLength() int {
+	return len(conn.queue)
+}
+
+// Stop the writer goroutine, the pending messages are discarded
+func (conn *Connection) Stop() {
+	if conn.done == nil {
+		return
+	}
+
+	conn.stopOnce.Do(func() {
+		close(conn.done)
+	})
+}
+
+// enqueue the message without blocking, returns false if the queue is full
+// the caller must hold the lock
+func (conn *Connection) enqueue(o outbound) bool {
+	select {
+	case conn.queue <- o:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeLoop writes the queued messages until the connection is stopped or closed
+func (conn *Connection) writeLoop() {
+	for {
+		select {
+		case <-conn.done:
+			return
+		case o := <-conn.queue:
+			if err := conn.write(o); err != nil {
+				log.Errorf("error writing into Socket %s, %+v", conn.SocketID, err)
+
+				// The client is gone or stalled, closing the socket makes the read loop disconnect it
+				if err := conn.Socket.Close(); err != nil {
+					log.Errorf("error closing Socket, %+v", err)
+				}
+
+				return
+			}
+
+			if o.closeFrame != nil {
+				return
+			}
+		}
+	}
+}
+
+func (conn *Connection) write(o outbound) error {
+	deadline := time.Now().Add(writeWait)
+
+	if o.closeFrame != nil {
+		return conn.Socket.WriteControl(websocket.CloseMessage, o.closeFrame, deadline)
+	}
+
+	if err := conn.Socket.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	if o.prepared != nil {
+		return conn.Socket.WritePreparedMessage(o.prepared)
+	}
+
+	return conn.Socket.WriteJSON(o.message)
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package connection
+
+import (
+	"testing"
+	"time"
+
+	"ipe/mocks"
+)
+
+// blockingSocket blocks the writes until it is released
+type blockingSocket struct {
+	mocks.MockSocket
+
+	release chan struct{}
+	written chan interface{}
+}
+
+func (s *blockingSocket) WriteJSON(i interface{}) error {
+	<-s.release
+	s.written <- i
+	return nil
+}
+
+func TestWriteQueue(t *testing.T) {
+	s := &blockingSocket{release: make(chan struct{}), written: make(chan interface{}, 10)}
+	c := New("socketID", s, WithWriteQueue(10, nil))
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		c.Publish(i)
+	}
+
+	close(s.release)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-s.written:
+			if m != i {
+				t.Errorf("m == %v, wants %v", m, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting the writer")
+		}
+	}
+}
+
+func TestWriteQueue_overflow(t *testing.T) {
+	overflows := make(chan *Connection, 10)
+
+	s := &blockingSocket{release: make(chan struct{}), written: make(chan interface{}, 10)}
+	c := New("socketID", s, WithWriteQueue(2, func(c *Connection) {
+		overflows <- c
+	}))
+	defer c.Stop()
+	defer close(s.release)
+
+	// One message is held by the writer, two are queued
+	for i := 0; i < 10; i++ {
+		c.Publish(i)
+	}
+
+	select {
+	case overflowed := <-overflows:
+		if overflowed != c {
+			t.Errorf("overflowed == %v, wants %v", overflowed, c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting the overflow")
+	}
+
+	if c.QueueLength() > 2 {
+		t.Errorf("c.QueueLength() == %d, wants at most %d", c.QueueLength(), 2)
+	}
+
+	if len(overflows) != 0 {
+		t.Errorf("len(overflows) == %d, wants %d", len(overflows), 0)
+	}
+}
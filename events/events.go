@@ -5,7 +5,9 @@
 package events
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 
 	log "github.com/golang/glog"
 
@@ -62,6 +64,50 @@ func NewUnsubscribe(channel string) Unsubscribe {
 	return Unsubscribe{Event: "pusher:unsubscribe", Data: data}
 }
 
+// SigninData data for Signin event
+type SigninData struct {
+	Auth     string `json:"auth"`
+	UserData string `json:"user_data"`
+}
+
+// Signin event
+// {
+//     "event": "pusher:signin",
+//     "data": {
+//         "auth": "<app key>:<signature>",
+//         "user_data": "{\"id\": \"123\"}"
+//     }
+// }
+type Signin struct {
+	Event string     `json:"event"`
+	Data  SigninData `json:"data"`
+}
+
+// SigninSuccess event
+// {
+//     "event": "pusher:signin_success",
+//     "data": "{\"user_data\": \"{\\\"id\\\": \\\"123\\\"}\"}"
+// }
+type SigninSuccess struct {
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+// NewSigninSuccess Create a new signin success event with the given user data
+func NewSigninSuccess(userData string) SigninSuccess {
+	b, err := json.Marshal(struct {
+		UserData string `json:"user_data"`
+	}{
+		UserData: userData,
+	})
+
+	if err != nil {
+		log.Error(err)
+	}
+
+	return SigninSuccess{Event: "pusher:signin_success", Data: string(b)}
+}
+
 // SubscriptionSucceeded event
 // {
 //     "event": "pusher_internal:subscription_succeeded",
@@ -78,6 +124,54 @@ func NewSubscriptionSucceeded(channel, data string) SubscriptionSucceeded {
 	return SubscriptionSucceeded{Event: "pusher_internal:subscription_succeeded", Channel: channel, Data: data}
 }
 
+// SubscriptionError event, sent when the subscription to a channel is refused
+// The other subscriptions of the connection are not affected.
+// {
+//     "event": "pusher:subscription_error",
+//     "channel": "presence-channel",
+//     "data": {
+//         "type": "LimitReached",
+//         "error": "presence channel is over capacity",
+//         "status": 4004
+//     }
+// }
+type SubscriptionError struct {
+	Event   string                `json:"event"`
+	Channel string                `json:"channel"`
+	Data    SubscriptionErrorData `json:"data"`
+}
+
+// SubscriptionErrorData the reason of a SubscriptionError
+type SubscriptionErrorData struct {
+	Type   string `json:"type"`
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// NewSubscriptionError Create a new subscription error event for the specified channel
+func NewSubscriptionError(channel, errorType, message string, status int) SubscriptionError {
+	return SubscriptionError{
+		Event:   "pusher:subscription_error",
+		Channel: channel,
+		Data:    SubscriptionErrorData{Type: errorType, Error: message, Status: status},
+	}
+}
+
+// CacheMiss event, sent when a cache channel does not have a cached event
+// {
+//     "event": "pusher:cache_miss",
+//     "channel": "cache-channel"
+// }
+type CacheMiss struct {
+	Event   string `json:"event"`
+	Channel string `json:"channel"`
+}
+
+// NewCacheMiss Create a new cache miss event for the specified channel
+func NewCacheMiss(channel string) CacheMiss {
+	return CacheMiss{Event: "pusher:cache_miss", Channel: channel}
+}
+
 // SubscriptionSucceededPresenceData Data Subscription Succeed
 // "{
 //     \"presence\": {
@@ -102,6 +196,7 @@ type SubscriptionSucceededPresenceData struct {
 }
 
 // NewSubscriptionSucceedPresenceData returns new SubscriptionSucceededPresenceData
+// A user subscribed with multiple connections is listed only once
 func NewSubscriptionSucceedPresenceData(subscriptions map[string]*subscription.Subscription) SubscriptionSucceededPresenceData {
 	event := SubscriptionSucceededPresenceData{}
 
@@ -117,13 +212,17 @@ func NewSubscriptionSucceedPresenceData(subscriptions map[string]*subscription.S
 			continue
 		}
 
+		if _, exists := hash[s.ID]; exists {
+			continue
+		}
+
 		hash[s.ID] = js
 		ids = append(ids, s.ID)
 	}
 
 	event.Ids = ids
 	event.Hash = hash
-	event.Count = len(subscriptions)
+	event.Count = len(ids)
 
 	return event
 }
@@ -205,12 +304,13 @@ type ConnectionEstablished struct {
 }
 
 // NewConnectionEstablished Create a new connection established event using the specified socketId
-func NewConnectionEstablished(socketID string) ConnectionEstablished {
+// activityTimeout is the number of seconds of inactivity before the client should ping the server
+func NewConnectionEstablished(socketID string, activityTimeout int) ConnectionEstablished {
 	b, err := json.Marshal(struct {
 		SocketID        string `json:"socket_id"`
 		ActivityTimeout int    `json:"activity_timeout"`
 	}{
-		SocketID: socketID, ActivityTimeout: 120,
+		SocketID: socketID, ActivityTimeout: activityTimeout,
 	})
 
 	if err != nil {
@@ -274,6 +374,7 @@ type Raw struct {
 	Event   string          `json:"event"`
 	Channel string          `json:"channel"`
 	Data    json.RawMessage `json:"data"`
+	UserID  string          `json:"user_id,omitempty"` // The sender of client events in presence channels
 }
 
 // Response event
@@ -281,6 +382,55 @@ type Response struct {
 	Event   string      `json:"event"`
 	Channel string      `json:"channel"`
 	Data    interface{} `json:"data"`
+	UserID  string      `json:"user_id,omitempty"`
+}
+
+// EncodeResponse Encodes the response event that is broadcasted to the client sockets
+// The data is written exactly as it was received, it is not decoded and encoded again
+// Empty data is encoded as null, like json.RawMessage does
+func EncodeResponse(event Raw) ([]byte, error) {
+	data := bytes.TrimSpace(event.Data)
+
+	if len(data) == 0 {
+		data = []byte("null")
+	}
+
+	if !json.Valid(data) {
+		return nil, errors.New("the event data is not valid JSON")
+	}
+
+	name, err := json.Marshal(event.Event)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := json.Marshal(event.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString(`{"event":`)
+	b.Write(name)
+	b.WriteString(`,"channel":`)
+	b.Write(channel)
+	b.WriteString(`,"data":`)
+	b.Write(data)
+
+	if event.UserID != "" {
+		userID, err := json.Marshal(event.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		b.WriteString(`,"user_id":`)
+		b.Write(userID)
+	}
+
+	b.WriteString("}")
+
+	return b.Bytes(), nil
 }
 
 // NewResponse The response event that is broadcasted to the client sockets
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"testing"
+
+	"ipe/subscription"
 )
 
 func Test_newErrorEvent_with_invalid_code(t *testing.T) {
@@ -27,3 +29,110 @@ func Test_newErrorEvent_with_valid_code(t *testing.T) {
 		t.Errorf("%s != %s", string(data), expected)
 	}
 }
+
+func Test_newSigninSuccess(t *testing.T) {
+	event := NewSigninSuccess(`{"id":"1"}`)
+
+	data, _ := json.Marshal(event)
+	expected := `{"event":"pusher:signin_success","data":"{\"user_data\":\"{\\\"id\\\":\\\"1\\\"}\"}"}`
+
+	if bytes.Compare(data, []byte(expected)) != 0 {
+		t.Errorf("%s != %s", string(data), expected)
+	}
+}
+
+func Test_newSubscriptionSucceedPresenceData_unique_users(t *testing.T) {
+	subscriptions := map[string]*subscription.Subscription{
+		"1": {ID: "1", Data: `{"name":"One"}`},
+		"2": {ID: "1", Data: `{"name":"One"}`},
+		"3": {ID: "2", Data: `{"name":"Two"}`},
+	}
+
+	data := NewSubscriptionSucceedPresenceData(subscriptions)
+
+	if data.Count != 2 {
+		t.Errorf("data.Count == %d, wants %d", data.Count, 2)
+	}
+
+	if len(data.Ids) != 2 {
+		t.Errorf("len(data.Ids) == %d, wants %d", len(data.Ids), 2)
+	}
+}
+
+func Test_newResponse_user_id(t *testing.T) {
+	event := NewResponse("client-event", "private-channel", "{}")
+
+	data, _ := json.Marshal(event)
+	expected := `{"event":"client-event","channel":"private-channel","data":"{}"}`
+
+	if bytes.Compare(data, []byte(expected)) != 0 {
+		t.Errorf("%s != %s", string(data), expected)
+	}
+
+	event.UserID = "1"
+
+	data, _ = json.Marshal(event)
+	expected = `{"event":"client-event","channel":"private-channel","data":"{}","user_id":"1"}`
+
+	if bytes.Compare(data, []byte(expected)) != 0 {
+		t.Errorf("%s != %s", string(data), expected)
+	}
+}
+
+func Test_encodeResponse_preserves_data(t *testing.T) {
+	event := Raw{Event: "my-event", Channel: "my-channel", Data: []byte(` {"z":1,"a":12345678901234567890.123456789} `)}
+
+	data, err := EncodeResponse(event)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"event":"my-event","channel":"my-channel","data":{"z":1,"a":12345678901234567890.123456789}}`
+
+	if bytes.Compare(data, []byte(expected)) != 0 {
+		t.Errorf("%s != %s", string(data), expected)
+	}
+
+	event.UserID = "1"
+	data, _ = EncodeResponse(event)
+	expected = `{"event":"my-event","channel":"my-channel","data":{"z":1,"a":12345678901234567890.123456789},"user_id":"1"}`
+
+	if bytes.Compare(data, []byte(expected)) != 0 {
+		t.Errorf("%s != %s", string(data), expected)
+	}
+
+	if _, err := EncodeResponse(Raw{Event: "my-event", Channel: "my-channel", Data: []byte(`{`)}); err == nil {
+		t.Errorf("EncodeResponse(...) == %v, wants an error", err)
+	}
+}
+
+func Test_encodeResponse_without_data(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte(""), []byte("  ")} {
+		encoded, err := EncodeResponse(Raw{Event: "my-event", Channel: "my-channel", Data: data})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := `{"event":"my-event","channel":"my-channel","data":null}`
+
+		if string(encoded) != expected {
+			t.Errorf("EncodeResponse(%q) == %s, wants %s", data, encoded, expected)
+		}
+	}
+}
+
+func Test_newSubscriptionError(t *testing.T) {
+	js, err := json.Marshal(NewSubscriptionError("presence-c1", "LimitReached", "presence channel is over capacity", 4004))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"event":"pusher:subscription_error","channel":"presence-c1","data":{"type":"LimitReached","error":"presence channel is over capacity","status":4004}}`
+
+	if string(js) != expected {
+		t.Errorf("json.Marshal(NewSubscriptionError(...)) == %s, wants %s", js, expected)
+	}
+}
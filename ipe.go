@@ -5,6 +5,7 @@
 package ipe
 
 import (
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
@@ -26,47 +27,15 @@ import (
 // Start Parse the configuration file and starts the ipe server
 // It Panic if could not start the HTTP or HTTPS server
 func Start(filename string) {
-	var conf config.File
-
 	rand.Seed(time.Now().Unix())
 
-	data, err := ioutil.ReadFile(filename)
+	conf, inMemoryStorage, err := load(filename)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	// Expand env vars
-	data = []byte(os.ExpandEnv(string(data)))
-
-	// Decoding config
-	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
-		log.Error(err)
-		return
-	}
-
-	// Using a in memory database
-	inMemoryStorage := storage.NewInMemory()
-
-	// Adding applications
-	for _, a := range conf.Apps {
-		application := app.NewApplication(
-			a.Name,
-			a.AppID,
-			a.Key,
-			a.Secret,
-			a.OnlySSL,
-			a.Enabled,
-			a.UserEvents,
-			a.WebHooks.Enabled,
-			a.WebHooks.URL,
-		)
-
-		if err := inMemoryStorage.AddApp(application); err != nil {
-			log.Error(err)
-			return
-		}
-	}
+	app.SetDeadLetterFile(conf.WebhooksDeadLetter)
 
 	router := mux.NewRouter()
 	router.Use(handlers.RecoveryHandler())
@@ -78,12 +47,15 @@ func Start(filename string) {
 	appsRouter := router.PathPrefix("/apps/{app_id}").Subrouter()
 	appsRouter.Use(
 		api.CheckAppDisabled(inMemoryStorage),
-		api.Authentication(inMemoryStorage),
+		api.Authentication(inMemoryStorage, conf.AuthTimestampWindowDuration()),
 	)
 
 	appsRouter.Path("/events").Methods("POST").Handler(
 		api.NewPostEvents(inMemoryStorage),
 	)
+	appsRouter.Path("/batch_events").Methods("POST").Handler(
+		api.NewPostBatchEvents(inMemoryStorage),
+	)
 	appsRouter.Path("/channels").Methods("GET").Handler(
 		api.NewGetChannels(inMemoryStorage),
 	)
@@ -93,6 +65,53 @@ func Start(filename string) {
 	appsRouter.Path("/channels/{channel_name}/users").Methods("GET").Handler(
 		api.NewGetChannelUsers(inMemoryStorage),
 	)
+	appsRouter.Path("/users/{user_id}/events").Methods("POST").Handler(
+		api.NewPostUserEvents(inMemoryStorage),
+	)
+	appsRouter.Path("/users/{user_id}/terminate_connections").Methods("POST").Handler(
+		api.NewPostTerminateUserConnections(inMemoryStorage),
+	)
+
+	if conf.Admin.Enabled {
+		adminRouter := mux.NewRouter()
+		adminRouter.Use(
+			handlers.RecoveryHandler(),
+			api.AdminAuthentication(conf.Admin.Key, conf.Admin.Secret, conf.AuthTimestampWindowDuration()),
+		)
+
+		adminRouter.Path("/apps").Methods("GET").Handler(
+			api.NewGetApps(inMemoryStorage),
+		)
+		adminRouter.Path("/apps").Methods("POST").Handler(
+			api.NewPostApps(inMemoryStorage),
+		)
+		adminRouter.Path("/apps/{app_id}").Methods("GET").Handler(
+			api.NewGetApp(inMemoryStorage),
+		)
+		adminRouter.Path("/apps/{app_id}").Methods("PUT").Handler(
+			api.NewPutApp(inMemoryStorage),
+		)
+		adminRouter.Path("/apps/{app_id}").Methods("DELETE").Handler(
+			api.NewDeleteApp(inMemoryStorage),
+		)
+		adminRouter.Path("/apps/{app_id}/enable").Methods("POST").Handler(
+			api.NewPostAppEnable(inMemoryStorage),
+		)
+		adminRouter.Path("/apps/{app_id}/disable").Methods("POST").Handler(
+			api.NewPostAppDisable(inMemoryStorage),
+		)
+		adminRouter.Path("/apps/{app_id}/rotate_secret").Methods("POST").Handler(
+			api.NewPostAppRotateSecret(inMemoryStorage),
+		)
+		adminRouter.Path("/webhooks/replay").Methods("POST").Handler(
+			api.NewPostReplayWebhooks(inMemoryStorage, conf.WebhooksDeadLetter),
+		)
+
+		go func() {
+			log.Infof("Starting admin HTTP service on %s ...", conf.Admin.Host)
+			log.Fatal(http.ListenAndServe(conf.Admin.Host, adminRouter))
+		}()
+	}
 
 	if conf.SSL.Enabled {
 		go func() {
@@ -104,3 +123,66 @@ func Start(filename string) {
 	log.Infof("Starting HTTP service on %s ...", conf.Host)
 	log.Fatal(http.ListenAndServe(conf.Host, router))
 }
+
+// ReplayWebhooks Parse the configuration file and delivers again the webhooks of the dead letter file
+func ReplayWebhooks(filename string) {
+	rand.Seed(time.Now().Unix())
+
+	conf, inMemoryStorage, err := load(filename)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if conf.WebhooksDeadLetter == "" {
+		log.Error("webhooks_dead_letter is not configured")
+		return
+	}
+
+	delivered, failed, err := app.ReplayDeadLetters(conf.WebhooksDeadLetter, inMemoryStorage.GetAppByAppID)
+	if err != nil {
+		log.Error(err)
+	}
+
+	log.Infof("%d webhooks delivered, %d webhooks failed again", delivered, failed)
+}
+
+// load Parse the configuration file and adds its applications to a new storage
+func load(filename string) (config.File, storage.Storage, error) {
+	var conf config.File
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	// Expand env vars
+	data = []byte(os.ExpandEnv(string(data)))
+
+	// Decoding config
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return conf, nil, err
+	}
+
+	if err := conf.Validate(); err != nil {
+		return conf, nil, err
+	}
+
+	// Using a in memory database
+	inMemoryStorage := storage.NewInMemory()
+
+	// Adding applications
+	for _, a := range conf.Apps {
+		if err := a.Validate(); err != nil {
+			return conf, nil, fmt.Errorf("invalid configuration for the app %s: %+v", a.AppID, err)
+		}
+
+		application := app.NewApplicationFromConfig(a)
+
+		if err := inMemoryStorage.AddApp(application); err != nil {
+			return conf, nil, err
+		}
+	}
+
+	return conf, inMemoryStorage, nil
+}
@@ -1,5 +1,11 @@
 package mocks
 
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
 // MockSocket is a mock implementation of Socket
 // used in the test suite
 type MockSocket struct{}
@@ -9,3 +15,33 @@ type MockSocket struct{}
 func (s MockSocket) WriteJSON(i interface{}) error {
 	return nil
 }
+
+// WritePreparedMessage always returns nil
+// used in the test suite
+func (s MockSocket) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	return nil
+}
+
+// Close always returns nil
+// used in the test suite
+func (s MockSocket) Close() error {
+	return nil
+}
+
+// WriteControl always returns nil
+// used in the test suite
+func (s MockSocket) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+// SetReadDeadline always returns nil
+// used in the test suite
+func (s MockSocket) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline always returns nil
+// used in the test suite
+func (s MockSocket) SetWriteDeadline(t time.Time) error {
+	return nil
+}
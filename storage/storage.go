@@ -7,6 +7,7 @@ package storage
 import (
 	"errors"
 	"ipe/app"
+	"ipe/config"
 	"sync"
 )
 
@@ -16,7 +17,10 @@ import (
 type Storage interface {
 	GetAppByAppID(appID string) (*app.Application, error)
 	GetAppByKey(key string) (*app.Application, error)
+	ListApps() ([]*app.Application, error)
 	AddApp(application *app.Application) error
+	UpdateApp(appID string, c config.Application) error
+	RemoveApp(appID string) error
 }
 
 // InMemory in memory implementation of Storage
@@ -31,14 +35,65 @@ func NewInMemory() Storage {
 }
 
 // AddApp adds app into memory
+// It fails if there is already an app with the same appID or key
 func (db *InMemory) AddApp(application *app.Application) error {
 	db.Lock()
 	defer db.Unlock()
 
+	if err := db.checkUnique(application.AppID, application.Key, nil); err != nil {
+		return err
+	}
+
 	db.Apps = append(db.Apps, application)
 	return nil
 }
 
+// UpdateApp applies the configuration to the app with the given appID
+// It fails if the app does not exists or if the new key is already in use, the app is not changed in that case
+func (db *InMemory) UpdateApp(appID string, c config.Application) error {
+	db.Lock()
+	defer db.Unlock()
+
+	for _, a := range db.Apps {
+		if a.AppID == appID {
+			if err := db.checkUnique(appID, c.Key, a); err != nil {
+				return err
+			}
+
+			a.Configure(c)
+			return nil
+		}
+	}
+
+	return errors.New("app not found")
+}
+
+// RemoveApp removes the app with the given appID from memory
+func (db *InMemory) RemoveApp(appID string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	for i, a := range db.Apps {
+		if a.AppID == appID {
+			db.Apps = append(db.Apps[:i], db.Apps[i+1:]...)
+			return nil
+		}
+	}
+
+	return errors.New("app not found")
+}
+
+// ListApps returns all the apps in memory
+func (db *InMemory) ListApps() ([]*app.Application, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	apps := make([]*app.Application, len(db.Apps))
+	copy(apps, db.Apps)
+
+	return apps, nil
+}
+
 // GetAppByAppID returns an App with by appID
 func (db *InMemory) GetAppByAppID(appID string) (*app.Application, error) {
 	db.RLock()
@@ -59,9 +114,29 @@ func (db *InMemory) GetAppByKey(key string) (*app.Application, error) {
 	defer db.RUnlock()
 
 	for _, a := range db.Apps {
-		if a.Key == key {
+		if appKey, _ := a.Credentials(); appKey == key {
 			return a, nil
 		}
 	}
 	return nil, errors.New("app not found")
 }
+
+// checkUnique verifies that no other app uses the appID or the key
+// the replaced app is not taken into account, must be called with the lock held
+func (db *InMemory) checkUnique(appID, key string, replaced *app.Application) error {
+	for _, a := range db.Apps {
+		if a == replaced {
+			continue
+		}
+
+		if a.AppID == appID {
+			return errors.New("app_id already in use")
+		}
+
+		if appKey, _ := a.Credentials(); key != "" && appKey == key {
+			return errors.New("key already in use")
+		}
+	}
+
+	return nil
+}
@@ -6,6 +6,7 @@ package storage
 
 import (
 	"ipe/app"
+	"ipe/config"
 	"testing"
 )
 
@@ -73,3 +74,75 @@ func Test_db_GetAppByKey__error(t *testing.T) {
 		t.Errorf("GetAppByKey(%q) == %+v, want %+v", "not-found", a, nil)
 	}
 }
+
+func Test_db_AddApp__duplicated(t *testing.T) {
+	storage := NewInMemory()
+	_ = storage.AddApp(&app.Application{AppID: "123456", Name: "Example", Key: "654321"})
+
+	if err := storage.AddApp(&app.Application{AppID: "123456", Name: "Example2", Key: "other"}); err == nil {
+		t.Errorf("AddApp(duplicated app_id) == %v, want !nil", err)
+	}
+
+	if err := storage.AddApp(&app.Application{AppID: "other", Name: "Example2", Key: "654321"}); err == nil {
+		t.Errorf("AddApp(duplicated key) == %v, want !nil", err)
+	}
+}
+
+func Test_db_ListApps(t *testing.T) {
+	storage := NewInMemory()
+	_ = storage.AddApp(&app.Application{AppID: "123456", Name: "Example"})
+	_ = storage.AddApp(&app.Application{AppID: "654321", Name: "Example2"})
+
+	apps, err := storage.ListApps()
+
+	if err != nil || len(apps) != 2 {
+		t.Errorf("ListApps() == %+v, %v, want 2 apps", apps, err)
+	}
+}
+
+func Test_db_UpdateApp(t *testing.T) {
+	storage := NewInMemory()
+	_app := &app.Application{AppID: "123456", Name: "Example", Key: "654321"}
+	_ = storage.AddApp(_app)
+	_ = storage.AddApp(&app.Application{AppID: "678901", Name: "Example2", Key: "109876"})
+
+	c := config.Application{AppID: "123456", Name: "Updated", Key: "654321"}
+
+	if err := storage.UpdateApp("123456", c); err != nil {
+		t.Errorf("UpdateApp(%q, %+v) == %v, want nil", "123456", c, err)
+	}
+
+	if a, _ := storage.GetAppByAppID("123456"); a != _app || a.Name != "Updated" {
+		t.Errorf("GetAppByAppID(%q) == %+v, want %+v", "123456", a, _app)
+	}
+
+	if err := storage.UpdateApp("123456", config.Application{AppID: "123456", Name: "Duplicated", Key: "109876"}); err == nil {
+		t.Errorf("UpdateApp(duplicated key) == %v, want !nil", err)
+	}
+
+	// A failed update does not change the app
+	if _app.Name != "Updated" || _app.Key != "654321" {
+		t.Errorf("_app == %+v, wants the previous name and key", _app)
+	}
+
+	if err := storage.UpdateApp("not-found", config.Application{}); err == nil {
+		t.Errorf("UpdateApp(not-found) == %v, want !nil", err)
+	}
+}
+
+func Test_db_RemoveApp(t *testing.T) {
+	storage := NewInMemory()
+	_ = storage.AddApp(&app.Application{AppID: "123456", Name: "Example"})
+
+	if err := storage.RemoveApp("123456"); err != nil {
+		t.Errorf("RemoveApp(%q) == %v, want nil", "123456", err)
+	}
+
+	if _, err := storage.GetAppByAppID("123456"); err == nil {
+		t.Errorf("GetAppByAppID(%q) == _, %v, want !nil", "123456", err)
+	}
+
+	if err := storage.RemoveApp("123456"); err == nil {
+		t.Errorf("RemoveApp(%q) == %v, want !nil", "123456", err)
+	}
+}
@@ -6,17 +6,24 @@ package utils
 
 import (
 	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"math"
 	"math/rand"
+	"net"
+	"net/url"
 	"regexp"
 	"strings"
 )
 
 var channelValidationRegex = regexp.MustCompile("^[A-Za-z0-9_\\-=@,.;]+$")
 
+// Prefix of the reserved channels used to send events to the signed in users
+const serverToUserPrefix = "#server-to-user-"
+
 // HashMAC Calculates the MAC signing with the given key and returns the hexadecimal encoded Result
 func HashMAC(message, key []byte) string {
 	mac := hmac.New(sha256.New, key)
@@ -31,6 +38,17 @@ func GenerateSessionID() string {
 	return fmt.Sprintf("%d.%d", rand.Intn(math.MaxInt32), rand.Intn(math.MaxInt32))
 }
 
+// GenerateKey Generate a random hexadecimal key with n random bytes, eg: to be used as app key or secret
+func GenerateKey(n int) string {
+	b := make([]byte, n)
+
+	if _, err := crand.Read(b); err != nil {
+		panic(fmt.Sprintf("utils: could not generate a random key, %+v", err))
+	}
+
+	return hex.EncodeToString(b)
+}
+
 // IsChannelNameValid Verify if the channel name is valid
 func IsChannelNameValid(channelName string) bool {
 	return channelValidationRegex.MatchString(channelName)
@@ -41,11 +59,105 @@ func IsPrivateChannel(channelName string) bool {
 	return strings.HasPrefix(channelName, "private-")
 }
 
+// IsPrivateEncryptedChannel Verify if the channel name represents a private encrypted channel
+// Private encrypted channels are also private channels
+func IsPrivateEncryptedChannel(channelName string) bool {
+	return strings.HasPrefix(channelName, "private-encrypted-")
+}
+
+// GenerateSharedSecret Derive the shared secret of a private encrypted channel from the base64 encoded master key
+// The shared secret is the SHA256 of the channel name concatenated with the master key
+func GenerateSharedSecret(channelName, encryptionMasterKey string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encryptionMasterKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(append([]byte(channelName), key...))
+
+	return sum[:], nil
+}
+
 // IsPresenceChannel Verify if the channel name represents a presence channel
 func IsPresenceChannel(channelName string) bool {
 	return strings.HasPrefix(channelName, "presence-")
 }
 
+// IsCacheChannel Verify if the channel name represents a cache channel
+// Cache channels can be public, private, private encrypted or presence channels
+func IsCacheChannel(channelName string) bool {
+	for _, prefix := range []string{"cache-", "private-cache-", "private-encrypted-cache-", "presence-cache-"} {
+		if strings.HasPrefix(channelName, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsServerToUserChannel Verify if the channel name represents a server to user channel
+func IsServerToUserChannel(channelName string) bool {
+	return strings.HasPrefix(channelName, serverToUserPrefix)
+}
+
+// ServerToUserChannel Returns the name of the server to user channel of the given user
+func ServerToUserChannel(userID string) string {
+	return serverToUserPrefix + userID
+}
+
+// MatchOrigin Verify if the origin of a request matches the allowed origin pattern
+//
+// The pattern can be "*", a host like "example.com" that matches any scheme,
+// a full origin like "https://example.com" or use a wildcard subdomain like "*.example.com".
+// The wildcard does not match the domain itself.
+// A pattern with a port like "localhost:3000" only matches that port, otherwise any port matches.
+func MatchOrigin(origin, pattern string) bool {
+	origin = strings.ToLower(strings.TrimSpace(origin))
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if pattern == "*" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+
+	host := pattern
+
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if pattern[:i] != u.Scheme {
+			return false
+		}
+
+		host = pattern[i+3:]
+	}
+
+	hostname, port := splitHostPort(host)
+
+	// Without a port in the pattern the origin can use any port
+	if port != "" && port != u.Port() {
+		return false
+	}
+
+	if strings.HasPrefix(hostname, "*.") {
+		return strings.HasSuffix(u.Hostname(), hostname[1:])
+	}
+
+	return u.Hostname() == hostname
+}
+
+// splitHostPort splits the host of an origin pattern, the port is empty if the pattern has none
+func splitHostPort(host string) (string, string) {
+	if hostname, port, err := net.SplitHostPort(host); err == nil {
+		return strings.Trim(hostname, "[]"), port
+	}
+
+	return strings.Trim(host, "[]"), ""
+}
+
 // IsClientEvent Verify if the event name represents a client event type
 func IsClientEvent(event string) bool {
 	return strings.HasPrefix(event, "client-")
@@ -5,6 +5,8 @@
 package utils
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"regexp"
 	"testing"
 )
@@ -125,3 +127,124 @@ func TestHashMAC(t *testing.T) {
 		t.Errorf("HashMAC(%s, %q) == %s, wants %s", message, key, digest, expected)
 	}
 }
+
+func TestGenerateKey(t *testing.T) {
+	key := GenerateKey(10)
+
+	if matched, _ := regexp.MatchString("^[0-9a-f]{20}$", key); !matched {
+		t.Errorf("Must match ^[0-9a-f]{20}$, value: '%s'", key)
+	}
+
+	if key == GenerateKey(10) {
+		t.Errorf("GenerateKey(10) == %s, wants a different key", key)
+	}
+}
+
+func TestIsPrivateEncryptedChannel(t *testing.T) {
+	name := "private-encrypted-hello"
+
+	if !IsPrivateEncryptedChannel(name) {
+		t.Errorf("IsPrivateEncryptedChannel(%s) == %t, wants %t", name, false, true)
+	}
+
+	if !IsPrivateChannel(name) {
+		t.Errorf("IsPrivateChannel(%s) == %t, wants %t", name, false, true)
+	}
+
+	name = "private-hello"
+
+	if IsPrivateEncryptedChannel(name) {
+		t.Errorf("IsPrivateEncryptedChannel(%s) == %t, wants %t", name, true, false)
+	}
+}
+
+func TestGenerateSharedSecret(t *testing.T) {
+	// See: https://github.com/pusher/pusher-http-go/blob/master/crypto_test.go
+	masterKey := base64.StdEncoding.EncodeToString([]byte("This is a string that is 32 chars"))
+	channelName := "private-encrypted-bla"
+
+	secret, err := GenerateSharedSecret(channelName, masterKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "004831f99d2a4e86723e893caded3a2897deeddbed9514fe9497dcddc52bd50b"
+
+	if hex.EncodeToString(secret) != expected {
+		t.Errorf("GenerateSharedSecret(%s, %s) == %x, wants %s", channelName, masterKey, secret, expected)
+	}
+
+	if _, err := GenerateSharedSecret(channelName, "not base64"); err == nil {
+		t.Errorf("GenerateSharedSecret(%s, 'not base64') == _, %v, wants !nil", channelName, err)
+	}
+}
+
+func TestIsServerToUserChannel(t *testing.T) {
+	name := ServerToUserChannel("123")
+
+	if name != "#server-to-user-123" {
+		t.Errorf("ServerToUserChannel(%s) == %s, wants %s", "123", name, "#server-to-user-123")
+	}
+
+	if !IsServerToUserChannel(name) {
+		t.Errorf("IsServerToUserChannel(%s) == %t, wants %t", name, false, true)
+	}
+
+	if IsServerToUserChannel("server-to-user-123") {
+		t.Errorf("IsServerToUserChannel(%s) == %t, wants %t", "server-to-user-123", true, false)
+	}
+}
+
+func TestIsCacheChannel(t *testing.T) {
+	for _, name := range []string{"cache-hello", "private-cache-hello", "private-encrypted-cache-hello", "presence-cache-hello"} {
+		if !IsCacheChannel(name) {
+			t.Errorf("IsCacheChannel(%s) == %t, wants %t", name, false, true)
+		}
+	}
+
+	for _, name := range []string{"hello", "private-hello", "presence-hello", "hello-cache-"} {
+		if IsCacheChannel(name) {
+			t.Errorf("IsCacheChannel(%s) == %t, wants %t", name, true, false)
+		}
+	}
+}
+
+func TestMatchOrigin(t *testing.T) {
+	testCases := []struct {
+		origin  string
+		pattern string
+		match   bool
+	}{
+		{"https://example.com", "*", true},
+		{"https://example.com", "example.com", true},
+		{"http://example.com", "example.com", true},
+		{"https://Example.com", "https://example.com", true},
+		{"http://example.com", "https://example.com", false},
+		{"https://app.example.com", "*.example.com", true},
+		{"https://a.b.example.com", "https://*.example.com", true},
+		{"http://app.example.com", "https://*.example.com", false},
+		{"https://example.com", "*.example.com", false},
+		{"https://badexample.com", "*.example.com", false},
+		{"https://example.com.evil.com", "example.com", false},
+		{"http://localhost:3000", "localhost:3000", true},
+		{"http://localhost:3001", "localhost:3000", false},
+		{"http://localhost", "localhost:3000", false},
+		{"http://localhost:3000", "localhost", true},
+		{"https://app.example.com:8443", "*.example.com", true},
+		{"https://app.example.com:8443", "https://*.example.com:8443", true},
+		{"https://app.example.com:8080", "*.example.com:8443", false},
+		{"https://app.example.com", "*.example.com:8443", false},
+		{"https://example.com:8443", "*.example.com", false},
+		{"https://app.badexample.com:8443", "*.example.com", false},
+		{"http://[::1]:3000", "[::1]:3000", true},
+		{"http://[::1]:3001", "[::1]:3000", false},
+		{"null", "example.com", false},
+	}
+
+	for _, tc := range testCases {
+		if match := MatchOrigin(tc.origin, tc.pattern); match != tc.match {
+			t.Errorf("MatchOrigin(%s, %s) == %t, wants %t", tc.origin, tc.pattern, match, tc.match)
+		}
+	}
+}
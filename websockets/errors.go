@@ -7,14 +7,36 @@ package websockets
 type websocketError struct {
 	Code int
 	Msg  string
+
+	// Fatal errors also close the connection with the same code, the others are only emitted
+	fatal bool
 }
 
+// The codes of the fatal errors tell the client how to reconnect
+//
+// 4000-4099: the client should not reconnect
+// 4100-4199: the client should reconnect with backoff
+// 4200-4299: the client should reconnect immediately
+//
+// Errors of a single message or subscription are not fatal, the connection is kept open.
 var (
-	applicationOnlyAcceptsSSL  = &websocketError{Code: 4000, Msg: "Application only accepts SSL connections, reconnect using wss://"}
-	applicationDoesNotExists   = &websocketError{Code: 4001, Msg: "Could not found an app with the given key"}
-	applicationDisabled        = &websocketError{Code: 4003, Msg: "Application disabled"}
-	invalidVersionStringFormat = &websocketError{Code: 4006, Msg: "Invalid version string format"}
-	unsupportedProtocolVersion = &websocketError{Code: 4007, Msg: "Unsupported protocol version"}
-	noProtocolVersionSupplied  = &websocketError{Code: 4008, Msg: "No protocol version supplied"}
-	reconnectImmediately       = &websocketError{Code: 4200, Msg: "Generic reconnect immediately"}
+	applicationOnlyAcceptsSSL  = &websocketError{Code: 4000, Msg: "Application only accepts SSL connections, reconnect using wss://", fatal: true}
+	applicationDoesNotExists   = &websocketError{Code: 4001, Msg: "Could not found an app with the given key", fatal: true}
+	applicationDisabled        = &websocketError{Code: 4003, Msg: "Application disabled", fatal: true}
+	invalidVersionStringFormat = &websocketError{Code: 4006, Msg: "Invalid version string format", fatal: true}
+	unsupportedProtocolVersion = &websocketError{Code: 4007, Msg: "Unsupported protocol version", fatal: true}
+	noProtocolVersionSupplied  = &websocketError{Code: 4008, Msg: "No protocol version supplied", fatal: true}
+	invalidSignin              = &websocketError{Code: 4009, Msg: "Connection not authorized: invalid signin signature", fatal: true}
+	invalidSigninUserData      = &websocketError{Code: 4009, Msg: "Connection not authorized: user_data must contain an id", fatal: true}
+	originNotAllowed           = &websocketError{Code: 4009, Msg: "Connection not authorized: origin not allowed", fatal: true}
+	slowConsumer               = &websocketError{Code: 4100, Msg: "Over capacity: the client is not reading the messages fast enough", fatal: true}
+	clientEventsLimitExceeded  = &websocketError{Code: 4101, Msg: "Too many client events rejected due to rate limit", fatal: true}
+	reconnectImmediately       = &websocketError{Code: 4200, Msg: "Generic reconnect immediately", fatal: true}
+	pongNotReceived            = &websocketError{Code: 4201, Msg: "Pong reply not received", fatal: true}
+
+	// Sent in the pusher:subscription_error of a full presence channel
+	overCapacity = &websocketError{Code: 4004, Msg: "Over capacity"}
+
+	clientEventRateLimited = &websocketError{Code: 4301, Msg: "Client event rejected due to rate limit"}
+	messageNotProcessed    = &websocketError{Code: 0, Msg: "The message could not be processed, try again"}
 )
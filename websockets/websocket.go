@@ -5,18 +5,21 @@
 package websockets
 
 import (
+	"crypto/hmac"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 
 	"ipe/app"
+	_channel "ipe/channel"
 	"ipe/connection"
 	"ipe/events"
 	"ipe/storage"
@@ -26,6 +29,27 @@ import (
 // Only this version is supported
 const supportedProtocolVersion = 7
 
+const (
+	// Time to wait for any message after a pusher:ping before closing the connection
+	pongTimeout = 30 * time.Second
+
+	// How often the activity of each connection is verified
+	activityCheckInterval = 5 * time.Second
+
+	// Consecutive rate limited client events before the connection is terminated
+	maxClientEventsRejected = 10
+
+	// Maximum length of the name of a client event
+	maxClientEventNameSize = 200
+
+	// Maximum size of the data of a client event, the same of the REST API
+	maxClientEventDataSize = 10 * 1000
+
+	// Messages waiting to be written before the connection is considered a slow consumer
+	writeQueueSize = 256
+)
+
+// The origin is verified after the app is resolved, see Application.IsOriginAllowed
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -46,14 +70,8 @@ func NewWebsocket(storage storage.Storage) *Websocket {
 
 // ServeHTTP Websocket GET /app/{key}
 func (h *Websocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The websocket is only written and closed through a connection.Connection
 	conn, err := upgrader.Upgrade(w, r, nil)
-	defer func() {
-		if conn != nil {
-			if err := conn.Close(); err != nil {
-				log.Errorf("closing the websocket connection %+v", err)
-			}
-		}
-	}()
 
 	if err != nil {
 		log.Error(err)
@@ -65,128 +83,210 @@ func (h *Websocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		appKey   = pathVars["key"]
 	)
 
+	sessionID := utils.GenerateSessionID()
+
 	_app, err := h.storage.GetAppByKey(appKey)
 
 	if err != nil {
 		log.Error(err)
-		emitError(applicationDoesNotExists, conn)
+		rejectConnection(conn, sessionID, applicationDoesNotExists)
 		return
 	}
 
-	sessionID := utils.GenerateSessionID()
+	_connection, wsErr := onOpen(conn, r, sessionID, _app)
 
-	if err := onOpen(conn, r, sessionID, _app); err != nil {
-		emitError(err, conn)
+	if wsErr != nil {
+		rejectConnection(conn, sessionID, wsErr)
 		return
 	}
 
-	handleMessages(conn, sessionID, _app)
+	defer _connection.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go watchActivity(_connection, _app, activityCheckInterval, pongTimeout, done)
+
+	handleMessages(conn, _connection, _app)
 }
 
-func handleMessages(conn *websocket.Conn, sessionID string, app *app.Application) {
-	var event struct {
-		Event string `json:"event"`
+// watchActivity sends a pusher:ping to the connection after the activity timeout of the app,
+// if the client does not send anything in the pongTimeout the connection is terminated
+// the activity is verified every interval
+func watchActivity(_connection *connection.Connection, app *app.Application, interval, pongTimeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pingedAt time.Time
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			activityTimeout := app.ActivityTimeoutDuration()
+			lastActivity := _connection.LastActivity()
+
+			switch {
+			case now.Sub(lastActivity) < activityTimeout:
+				pingedAt = time.Time{}
+			case pingedAt.IsZero() || lastActivity.After(pingedAt):
+				_connection.Publish(events.NewPing())
+				pingedAt = now
+			case now.Sub(pingedAt) >= pongTimeout:
+				log.Infof("socket %s did not reply to pusher:ping, terminating", _connection.SocketID)
+				app.Stats.Add("TotalInactiveConnectionsClosed", 1)
+				app.Terminate(_connection, pongNotReceived.Code, pongNotReceived.Msg)
+				return
+			}
+		}
 	}
+}
+
+func handleMessages(conn *websocket.Conn, _connection *connection.Connection, app *app.Application) {
+	var (
+		sessionID = _connection.SocketID
+		event     struct {
+			Event string `json:"event"`
+		}
+	)
 
 	for {
 		_, message, err := conn.ReadMessage()
 
 		if err != nil {
-			handleError(conn, sessionID, app, err)
+			handleError(_connection, app, err)
 			return
 		}
 
+		// The close handshake was started, discard everything until the client replies
+		if _connection.IsClosing() {
+			continue
+		}
+
+		// Any message is a sign of life
+		_connection.Touch()
+
+		// Not a Pusher message, the connection is closed and the client reconnects
 		if err := json.Unmarshal(message, &event); err != nil {
-			emitError(reconnectImmediately, conn)
-			return
+			emitError(reconnectImmediately, _connection)
+			continue
 		}
 
 		log.Infof("websocket: Handling %s event", event.Event)
 
 		switch event.Event {
 		case "pusher:ping":
-			handlePing(conn)
+			handlePing(_connection)
+		case "pusher:pong":
+			// Reply to the server ping, the activity was already recorded
 		case "pusher:subscribe":
-			handleSubscribe(conn, sessionID, app, message)
+			handleSubscribe(_connection, sessionID, app, message)
 		case "pusher:unsubscribe":
-			handleUnsubscribe(conn, sessionID, app, message)
+			handleUnsubscribe(_connection, sessionID, app, message)
+		case "pusher:signin":
+			handleSignin(_connection, sessionID, app, message)
 		default:
 			if utils.IsClientEvent(event.Event) {
-				handleClientEvent(conn, sessionID, app, message)
+				handleClientEvent(_connection, sessionID, app, message)
 			}
 		}
 	}
 }
 
 // Emit an Websocket ErrorEvent
-func emitError(err *websocketError, conn *websocket.Conn) {
-	event := events.NewError(err.Code, err.Msg)
+// Fatal errors also start the close handshake using the error code
+func emitError(err *websocketError, conn *connection.Connection) {
+	conn.Publish(events.NewError(err.Code, err.Msg))
 
-	if err := conn.WriteJSON(event); err != nil {
-		log.Error(err)
+	if err.fatal {
+		conn.CloseWithError(err.Code, err.Msg)
 	}
 }
 
-func handleError(conn *websocket.Conn, sessionID string, app *app.Application, err error) {
-	log.Errorf("%+v", err)
-	if err == io.EOF {
-		onClose(sessionID, app)
-	} else if _, ok := err.(*websocket.CloseError); ok {
-		onClose(sessionID, app)
-	} else {
-		emitError(reconnectImmediately, conn)
+// rejectConnection closes a websocket that was not accepted
+// and waits the client to reply the close handshake
+func rejectConnection(conn *websocket.Conn, sessionID string, err *websocketError) {
+	_connection := connection.New(sessionID, conn)
+	defer _connection.Close()
+
+	emitError(err, _connection)
+
+	// The read deadline was set by the close handshake
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
 	}
 }
 
-func onOpen(conn *websocket.Conn, r *http.Request, sessionID string, app *app.Application) *websocketError {
+// handleError The websocket can not be read anymore, the connection is always closed
+func handleError(conn *connection.Connection, app *app.Application, err error) {
+	if _, ok := err.(*websocket.CloseError); !ok && err != io.EOF {
+		log.Errorf("%+v", err)
+	}
+
+	onClose(conn.SocketID, app)
+}
+
+func onOpen(conn *websocket.Conn, r *http.Request, sessionID string, app *app.Application) (*connection.Connection, *websocketError) {
 	var (
 		queryVars   = r.URL.Query()
 		strProtocol = queryVars.Get("protocol")
+		settings    = app.Config()
 	)
 
 	protocol, err := strconv.Atoi(strProtocol)
 	if err != nil {
-		return invalidVersionStringFormat
+		return nil, invalidVersionStringFormat
 	}
 
 	switch {
 	case strings.TrimSpace(strProtocol) == "":
-		return noProtocolVersionSupplied
+		return nil, noProtocolVersionSupplied
 	case protocol != supportedProtocolVersion:
-		return unsupportedProtocolVersion
-	case !app.Enabled:
-		return applicationDisabled
-	case app.OnlySSL:
+		return nil, unsupportedProtocolVersion
+	case !settings.Enabled:
+		return nil, applicationDisabled
+	case !app.IsOriginAllowed(r.Header.Get("Origin")):
+		return nil, originNotAllowed
+	case settings.OnlySSL:
 		if r.TLS == nil {
-			return applicationOnlyAcceptsSSL
+			return nil, applicationOnlyAcceptsSSL
 		}
 	}
 
 	// Create the new Subscriber
-	_connection := connection.New(sessionID, conn)
-	app.Connect(_connection)
+	_connection := connection.New(
+		sessionID,
+		conn,
+		connection.WithClientEventsLimit(settings.ClientEventsPerSecond),
+		connection.WithWriteQueue(writeQueueSize, func(c *connection.Connection) {
+			app.Stats.Add("TotalSlowConsumers", 1)
+			app.Terminate(c, slowConsumer.Code, slowConsumer.Msg)
+		}),
+	)
 
 	// Everything went fine.
-	if err := conn.WriteJSON(events.NewConnectionEstablished(_connection.SocketID)); err != nil {
-		return reconnectImmediately
-	}
+	// Queued before the connection is visible, so it is always the first message
+	_connection.Publish(events.NewConnectionEstablished(_connection.SocketID, settings.ActivityTimeout))
+	app.Connect(_connection)
 
-	return nil
+	return _connection, nil
 }
 
 func onClose(sessionID string, app *app.Application) {
 	app.Disconnect(sessionID)
 }
 
-func handlePing(conn *websocket.Conn) {
-	if err := conn.WriteJSON(events.NewPong()); err != nil {
-		emitError(reconnectImmediately, conn)
-	}
+func handlePing(_connection *connection.Connection) {
+	_connection.Publish(events.NewPong())
 }
 
-func handleClientEvent(conn *websocket.Conn, sessionID string, app *app.Application, message []byte) {
-	if !app.UserEvents {
+func handleClientEvent(conn *connection.Connection, sessionID string, app *app.Application, message []byte) {
+	if !app.AllowsUserEvents() {
 		emitError(&websocketError{Code: 0, Msg: "To send client events, you must enable this feature in the Settings."}, conn)
+		return
 	}
 
 	clientEvent := events.Raw{}
@@ -197,10 +297,43 @@ func handleClientEvent(conn *websocket.Conn, sessionID string, app *app.Applicat
 		return
 	}
 
-	channel, err := app.FindChannelByChannelID(clientEvent.Channel)
+	_connection, err := app.FindConnection(sessionID)
 
 	if err != nil {
-		emitError(&websocketError{Code: 0, Msg: fmt.Sprintf("Could not find a channel with the id %s", clientEvent.Channel)}, conn)
+		emitError(reconnectImmediately, conn)
+		return
+	}
+
+	if allowed, rejected := _connection.AllowClientEvent(); !allowed {
+		app.Stats.Add("TotalClientEventsRejected", 1)
+
+		if rejected > maxClientEventsRejected {
+			// 4301 would make the client give up, it can reconnect with backoff
+			log.Infof("socket %s exceeded the client events limit, terminating", sessionID)
+			app.Terminate(_connection, clientEventsLimitExceeded.Code, clientEventsLimitExceeded.Msg)
+			return
+		}
+
+		_connection.Publish(events.NewError(clientEventRateLimited.Code, clientEventRateLimited.Msg))
+		return
+	}
+
+	if len(clientEvent.Event) > maxClientEventNameSize {
+		emitError(&websocketError{Code: 0, Msg: fmt.Sprintf("Client event rejected - event name longer than %d characters", maxClientEventNameSize)}, conn)
+		return
+	}
+
+	if len(clientEvent.Data) > maxClientEventDataSize {
+		emitError(&websocketError{Code: 0, Msg: fmt.Sprintf("Client event rejected - data larger than %d bytes", maxClientEventDataSize)}, conn)
+		return
+	}
+
+	// Only the subscribers can talk in the channel
+	// the rejection is the same if the channel does not exist, so the names can not be guessed
+	channel, err := app.FindChannelByChannelID(clientEvent.Channel)
+
+	if err != nil || !channel.IsSubscribed(_connection) {
+		emitError(&websocketError{Code: 0, Msg: fmt.Sprintf("Client event rejected - not subscribed to %s", clientEvent.Channel)}, conn)
 		return
 	}
 
@@ -209,14 +342,33 @@ func handleClientEvent(conn *websocket.Conn, sessionID string, app *app.Applicat
 		return
 	}
 
+	if channel.IsPrivateEncrypted() {
+		emitError(&websocketError{Code: 0, Msg: "Client event rejected - not supported on private-encrypted channels"}, conn)
+		return
+	}
+
+	// The user_id is always set by the server, never trust the client
+	clientEvent.UserID = ""
+
+	if channel.IsPresence() {
+		_subscription, err := channel.Subscription(_connection)
+
+		if err != nil {
+			emitError(messageNotProcessed, conn)
+			return
+		}
+
+		clientEvent.UserID = _subscription.ID
+	}
+
 	if err := app.Publish(channel, clientEvent, sessionID); err != nil {
 		log.Error(err)
-		emitError(reconnectImmediately, conn)
+		emitError(messageNotProcessed, conn)
 		return
 	}
 }
 
-func handleUnsubscribe(conn *websocket.Conn, sessionID string, app *app.Application, message []byte) {
+func handleUnsubscribe(conn *connection.Connection, sessionID string, app *app.Application, message []byte) {
 	unsubscribeEvent := events.Unsubscribe{}
 
 	if err := json.Unmarshal(message, &unsubscribeEvent); err != nil {
@@ -239,12 +391,12 @@ func handleUnsubscribe(conn *websocket.Conn, sessionID string, app *app.Applicat
 	}
 
 	if err := app.Unsubscribe(channel, _connection); err != nil {
-		emitError(reconnectImmediately, conn)
+		emitError(messageNotProcessed, conn)
 		return
 	}
 }
 
-func handleSubscribe(conn *websocket.Conn, sessionID string, app *app.Application, message []byte) {
+func handleSubscribe(conn *connection.Connection, sessionID string, app *app.Application, message []byte) {
 	subscribeEvent := events.Subscribe{}
 
 	if err := json.Unmarshal(message, &subscribeEvent); err != nil {
@@ -261,7 +413,15 @@ func handleSubscribe(conn *websocket.Conn, sessionID string, app *app.Applicatio
 
 	channelName := strings.TrimSpace(subscribeEvent.Data.Channel)
 
-	if !utils.IsChannelNameValid(channelName) {
+	// Only the signed in user can subscribe to its own server to user channel
+	if utils.IsServerToUserChannel(channelName) {
+		userID := _connection.UserID()
+
+		if userID == "" || channelName != utils.ServerToUserChannel(userID) {
+			emitError(&websocketError{Code: 0, Msg: fmt.Sprintf("Subscription to %s is only allowed for the signed in user", channelName)}, conn)
+			return
+		}
+	} else if !utils.IsChannelNameValid(channelName) {
 		emitError(&websocketError{Code: 0, Msg: "This channel name is not valid"}, conn)
 		return
 	}
@@ -269,6 +429,12 @@ func handleSubscribe(conn *websocket.Conn, sessionID string, app *app.Applicatio
 	isPresence := utils.IsPresenceChannel(channelName)
 	isPrivate := utils.IsPrivateChannel(channelName)
 
+	// The app must have a master key to hand out the shared secrets of the encrypted channels
+	if utils.IsPrivateEncryptedChannel(channelName) && app.Config().EncryptionMasterKey == "" {
+		emitError(&websocketError{Code: 0, Msg: "Encrypted channels are not enabled for this application, configure an encryption_master_key"}, conn)
+		return
+	}
+
 	if isPresence || isPrivate {
 		toSign := []string{_connection.SocketID, channelName}
 
@@ -285,12 +451,58 @@ func handleSubscribe(conn *websocket.Conn, sessionID string, app *app.Applicatio
 	channel := app.FindOrCreateChannelByChannelID(channelName)
 	log.Info(subscribeEvent.Data.ChannelData)
 
-	if err := app.Subscribe(channel, _connection, subscribeEvent.Data.ChannelData); err != nil {
+	// The refused subscriptions only affect the channel, the connection is kept
+	switch err := app.Subscribe(channel, _connection, subscribeEvent.Data.ChannelData); err {
+	case nil:
+	case _channel.ErrOverCapacity:
+		conn.Publish(events.NewSubscriptionError(channelName, "LimitReached", err.Error(), overCapacity.Code))
+	case _channel.ErrUserIDTooLong, _channel.ErrUserInfoTooLarge:
+		conn.Publish(events.NewSubscriptionError(channelName, "InvalidChannelData", err.Error(), 0))
+	default:
+		emitError(messageNotProcessed, conn)
+	}
+}
+
+func handleSignin(conn *connection.Connection, sessionID string, app *app.Application, message []byte) {
+	signinEvent := events.Signin{}
+
+	if err := json.Unmarshal(message, &signinEvent); err != nil {
+		emitError(reconnectImmediately, conn)
+		return
+	}
+
+	_connection, err := app.FindConnection(sessionID)
+
+	if err != nil {
 		emitError(reconnectImmediately, conn)
+		return
+	}
+
+	// The user authentication signs <socket_id>::user::<user_data>
+	toSign := []string{_connection.SocketID + "::user::" + signinEvent.Data.UserData}
+
+	if !validateAuthKey(signinEvent.Data.Auth, toSign, app) {
+		emitError(invalidSignin, conn)
+		return
 	}
+
+	var userData struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.Unmarshal([]byte(signinEvent.Data.UserData), &userData); err != nil || strings.TrimSpace(userData.ID) == "" {
+		emitError(invalidSigninUserData, conn)
+		return
+	}
+
+	_connection.SignIn(userData.ID)
+	log.Infof("socket %s signed in as user %s", sessionID, userData.ID)
+
+	_connection.Publish(events.NewSigninSuccess(signinEvent.Data.UserData))
 }
 
 func validateAuthKey(givenAuthKey string, toSign []string, app *app.Application) bool {
-	expectedAuthKey := fmt.Sprintf("%s:%s", app.Key, utils.HashMAC([]byte(strings.Join(toSign, ":")), []byte(app.Secret)))
-	return givenAuthKey == expectedAuthKey
+	key, secret := app.Credentials()
+	expectedAuthKey := fmt.Sprintf("%s:%s", key, utils.HashMAC([]byte(strings.Join(toSign, ":")), []byte(secret)))
+	return hmac.Equal([]byte(givenAuthKey), []byte(expectedAuthKey))
 }
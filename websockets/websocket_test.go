@@ -0,0 +1,351 @@
+// Copyright 2018 Claudemiro Alves Feitosa Neto. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package websockets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"ipe/app"
+	"ipe/connection"
+	"ipe/events"
+	"ipe/mocks"
+)
+
+// recordingSocket records the messages and the close frame written into it
+type recordingSocket struct {
+	mocks.MockSocket
+
+	mutex    sync.Mutex
+	messages []interface{}
+	prepared int
+	closeMsg []byte
+}
+
+func (s *recordingSocket) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.prepared++
+	return nil
+}
+
+func (s *recordingSocket) WriteJSON(i interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = append(s.messages, i)
+	return nil
+}
+
+func (s *recordingSocket) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closeMsg = data
+	return nil
+}
+
+// written returns the messages and the close frame written so far
+func (s *recordingSocket) written() ([]interface{}, []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]interface{}(nil), s.messages...), s.closeMsg
+}
+
+// encode returns the JSON written into the websocket for the message
+func encode(message interface{}) string {
+	b, _ := json.Marshal(message)
+	return string(b)
+}
+
+func TestEmitError(t *testing.T) {
+	testCases := []struct {
+		err   *websocketError
+		close bool
+	}{
+		{reconnectImmediately, true},
+		{applicationDisabled, true},
+		{invalidSignin, true},
+		{messageNotProcessed, false},
+		{clientEventRateLimited, false},
+		{&websocketError{Code: 0, Msg: "This channel name is not valid"}, false},
+	}
+
+	for _, tc := range testCases {
+		s := &recordingSocket{}
+		conn := connection.New("1", s)
+
+		emitError(tc.err, conn)
+
+		messages, closeMsg := s.written()
+
+		if len(messages) != 1 || encode(messages[0]) != encode(events.NewError(tc.err.Code, tc.err.Msg)) {
+			t.Errorf("messages == %+v, wants the %d error", messages, tc.err.Code)
+		}
+
+		if conn.IsClosing() != tc.close {
+			t.Errorf("emitError(%d) closing == %t, wants %t", tc.err.Code, conn.IsClosing(), tc.close)
+		}
+
+		if tc.close && string(closeMsg) != string(websocket.FormatCloseMessage(tc.err.Code, tc.err.Msg)) {
+			t.Errorf("closeMsg == %q, wants the code %d", closeMsg, tc.err.Code)
+		}
+	}
+}
+
+// newTestConnection returns a connection of a new app with client events, subscribed to the given channels
+func newTestConnection(t *testing.T, channels map[string]string, options ...connection.Option) (*app.Application, *connection.Connection, *recordingSocket) {
+	a := app.NewApplication("Test", "1", "key", "secret", false, true, true, false, "")
+
+	s := &recordingSocket{}
+	conn := connection.New("1.1", s, options...)
+	a.Connect(conn)
+
+	for name, data := range channels {
+		if err := a.Subscribe(a.FindOrCreateChannelByChannelID(name), conn, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return a, conn, s
+}
+
+func TestHandleClientEvent_rate_limit_terminates(t *testing.T) {
+	a, conn, s := newTestConnection(t, map[string]string{"private-a": ""}, connection.WithClientEventsLimit(1))
+	message := []byte(`{"event":"client-a","channel":"private-a","data":{}}`)
+
+	// The first event is allowed, then the rejections are counted until the limit
+	for i := 0; i <= maxClientEventsRejected+1; i++ {
+		handleClientEvent(conn, conn.SocketID, a, message)
+	}
+
+	messages, closeMsg := s.written()
+
+	if last := encode(messages[len(messages)-2]); last != encode(events.NewError(clientEventRateLimited.Code, clientEventRateLimited.Msg)) {
+		t.Errorf("messages[-2] == %s, wants the %d error", last, clientEventRateLimited.Code)
+	}
+
+	if string(closeMsg) != string(websocket.FormatCloseMessage(clientEventsLimitExceeded.Code, clientEventsLimitExceeded.Msg)) {
+		t.Errorf("closeMsg == %q, wants the code %d", closeMsg, clientEventsLimitExceeded.Code)
+	}
+
+	if clientEventsLimitExceeded.Code < 4100 || clientEventsLimitExceeded.Code >= 4200 {
+		t.Errorf("clientEventsLimitExceeded.Code == %d, wants a code to reconnect with backoff", clientEventsLimitExceeded.Code)
+	}
+
+	if _, err := a.FindConnection(conn.SocketID); err == nil {
+		t.Errorf("a.FindConnection(%s) == _, %v, wants !nil", conn.SocketID, err)
+	}
+}
+
+func TestHandleClientEvent_not_subscribed(t *testing.T) {
+	a, conn, s := newTestConnection(t, nil)
+
+	// Other connection is subscribed, so the channel exists
+	subscriber := &recordingSocket{}
+	subscriberConn := connection.New("2.2", subscriber)
+	a.Connect(subscriberConn)
+
+	if err := a.Subscribe(a.FindOrCreateChannelByChannelID("private-a"), subscriberConn, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"private-a", "private-missing"} {
+		handleClientEvent(conn, conn.SocketID, a, []byte(`{"event":"client-a","channel":"`+name+`","data":{}}`))
+	}
+
+	messages, _ := s.written()
+
+	if len(messages) != 2 {
+		t.Fatalf("messages == %+v, wants %d errors", messages, 2)
+	}
+
+	for i, name := range []string{"private-a", "private-missing"} {
+		expected := events.NewError(0, "Client event rejected - not subscribed to "+name)
+
+		if encode(messages[i]) != encode(expected) {
+			t.Errorf("messages[%d] == %s, wants %s", i, encode(messages[i]), encode(expected))
+		}
+	}
+
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if subscriber.prepared != 0 {
+		t.Errorf("subscriber.prepared == %d, wants %d", subscriber.prepared, 0)
+	}
+}
+
+// newWebsocketPair returns the server and the client side of a real websocket connection
+func newWebsocketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		accepted <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := <-accepted
+
+	t.Cleanup(func() {
+		socket.Close()
+		client.Close()
+	})
+
+	return socket, client
+}
+
+func TestHandleClientEvent_presence_user_id(t *testing.T) {
+	a, conn, _ := newTestConnection(t, map[string]string{"presence-a": `{"user_id":"sender"}`})
+
+	socket, client := newWebsocketPair(t)
+	subscriberConn := connection.New("2.2", socket)
+	a.Connect(subscriberConn)
+
+	if err := a.Subscribe(a.FindOrCreateChannelByChannelID("presence-a"), subscriberConn, `{"user_id":"receiver"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user_id sent by the client is replaced by the one of its subscription
+	handleClientEvent(conn, conn.SocketID, a, []byte(`{"event":"client-a","channel":"presence-a","data":{},"user_id":"forged"}`))
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+	for {
+		var event struct {
+			Event  string `json:"event"`
+			UserID string `json:"user_id"`
+		}
+
+		if err := client.ReadJSON(&event); err != nil {
+			t.Fatalf("the client event was not received: %+v", err)
+		}
+
+		if event.Event != "client-a" {
+			continue
+		}
+
+		if event.UserID != "sender" {
+			t.Errorf("event.UserID == %q, wants %q", event.UserID, "sender")
+		}
+
+		return
+	}
+}
+
+// countPings returns the number of pusher:ping written into the socket
+func countPings(s *recordingSocket) int {
+	messages, _ := s.written()
+	total := 0
+
+	for _, message := range messages {
+		if encode(message) == encode(events.NewPing()) {
+			total++
+		}
+	}
+
+	return total
+}
+
+// startWatchActivity watches the connection with an activity timeout of one second
+// the returned channel is closed when watchActivity returns
+func startWatchActivity(a *app.Application, conn *connection.Connection, pongTimeout time.Duration, done chan struct{}) chan struct{} {
+	a.ActivityTimeout = 1
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		watchActivity(conn, a, 10*time.Millisecond, pongTimeout, done)
+	}()
+
+	return stopped
+}
+
+func TestWatchActivity_activity_resets_the_ping(t *testing.T) {
+	a, conn, s := newTestConnection(t, nil)
+	done := make(chan struct{})
+	stopped := startWatchActivity(a, conn, time.Second, done)
+
+	for deadline := time.Now().Add(1500 * time.Millisecond); time.Now().Before(deadline); {
+		conn.Touch()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	close(done)
+	<-stopped
+
+	if pings := countPings(s); pings != 0 {
+		t.Errorf("pings == %d, wants %d", pings, 0)
+	}
+}
+
+func TestWatchActivity_pings_once(t *testing.T) {
+	a, conn, s := newTestConnection(t, nil)
+	done := make(chan struct{})
+	stopped := startWatchActivity(a, conn, time.Minute, done)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	close(done)
+	<-stopped
+
+	if pings := countPings(s); pings != 1 {
+		t.Errorf("pings == %d, wants %d", pings, 1)
+	}
+
+	if conn.IsClosing() {
+		t.Errorf("conn.IsClosing() == %t, wants %t", true, false)
+	}
+}
+
+func TestWatchActivity_terminates_without_pong(t *testing.T) {
+	a, conn, s := newTestConnection(t, nil)
+	done := make(chan struct{})
+	defer close(done)
+
+	select {
+	case <-startWatchActivity(a, conn, 100*time.Millisecond, done):
+	case <-time.After(3 * time.Second):
+		t.Fatal("the connection was not terminated")
+	}
+
+	if pings := countPings(s); pings != 1 {
+		t.Errorf("pings == %d, wants %d", pings, 1)
+	}
+
+	if _, closeMsg := s.written(); string(closeMsg) != string(websocket.FormatCloseMessage(pongNotReceived.Code, pongNotReceived.Msg)) {
+		t.Errorf("closeMsg == %q, wants the code %d", closeMsg, pongNotReceived.Code)
+	}
+
+	if _, err := a.FindConnection(conn.SocketID); err == nil {
+		t.Errorf("a.FindConnection(%s) == _, %v, wants !nil", conn.SocketID, err)
+	}
+
+	if closed := a.Stats.Get("TotalInactiveConnectionsClosed").String(); closed != "1" {
+		t.Errorf("TotalInactiveConnectionsClosed == %s, wants %d", closed, 1)
+	}
+}